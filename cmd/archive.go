@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+// archiveFormat normalises a --format value
+func archiveFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "tar.gz", "tgz":
+		return "tar.gz", nil
+	case "zip":
+		return "zip", nil
+	}
+	return "", fmt.Errorf("unknown archive format %q (expected tar.gz or zip)", name)
+}
+
+// archiveUpload packs localDir, uploads it as one file and unpacks it into
+// remoteDir in the guest
+func archiveUpload(ctx context.Context, g *vsphere.Guest, localDir, remoteDir, format string) error {
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", localDir)
+	}
+
+	spool, err := os.CreateTemp("", "guest-cli-archive-*")
+	if err != nil {
+		return fmt.Errorf("failed to create local temp file: %w", err)
+	}
+	defer removeSpool(spool)
+
+	h := sha256.New()
+	if err := packLocal(localDir, format, io.MultiWriter(spool, h)); err != nil {
+		return fmt.Errorf("failed to pack %s: %w", localDir, err)
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	dir, err := createGuestWorkspace(ctx, g)
+	if err != nil {
+		return err
+	}
+	defer removeGuestWorkspace(ctx, g, dir)
+
+	archive := guestJoin(g, dir, "archive."+format)
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Uploading %s as a %d byte %s archive...\n", localDir, size, format)
+	}
+	p := newProgress(localDir, size, false)
+	err = g.Upload(ctx, archive, p.Reader(spool), size, nil, true)
+	p.Finish()
+	if err != nil {
+		return err
+	}
+	if cpVerify {
+		if err := verifySum(ctx, g, archive, hex.EncodeToString(h.Sum(nil))); err != nil {
+			return err
+		}
+	}
+
+	gc := guestCommand{Dir: dir}
+	switch {
+	case g.IsWindows() && format == "zip":
+		gc.Shell = "powershell"
+		gc.Cmd = fmt.Sprintf("Expand-Archive -LiteralPath %s -DestinationPath %s -Force", psQuote(archive), psQuote(remoteDir))
+	case g.IsWindows():
+		gc.Shell = "powershell"
+		gc.Cmd = fmt.Sprintf("$null = New-Item -ItemType Directory -Force -Path %s\ntar.exe -xzf %s -C %[1]s", psQuote(remoteDir), psQuote(archive))
+	case format == "zip":
+		gc.Cmd = fmt.Sprintf("unzip -o -q %s -d %s", shellQuote(archive), shellQuote(remoteDir))
+	default:
+		gc.Cmd = fmt.Sprintf("mkdir -p -- %s && tar -xzf %s -C %[1]s", shellQuote(remoteDir), shellQuote(archive))
+	}
+	if _, err := runGuestCheck(ctx, g, gc); err != nil {
+		return fmt.Errorf("failed to unpack into %s: %w", remoteDir, err)
+	}
+	return nil
+}
+
+// archiveDownload packs remoteDir in the guest, downloads it as one file and
+// unpacks it into localDir, or writes the archive to stdout if localDir is "-"
+func archiveDownload(ctx context.Context, g *vsphere.Guest, remoteDir, localDir, format string) error {
+	dir, err := createGuestWorkspace(ctx, g)
+	if err != nil {
+		return err
+	}
+	defer removeGuestWorkspace(ctx, g, dir)
+
+	archive := guestJoin(g, dir, "archive."+format)
+	gc := guestCommand{Dir: dir}
+	switch {
+	case g.IsWindows() && format == "zip":
+		gc.Shell = "powershell"
+		gc.Cmd = fmt.Sprintf("Compress-Archive -Path (Join-Path %s '*') -DestinationPath %s", psQuote(remoteDir), psQuote(archive))
+	case g.IsWindows():
+		gc.Shell = "powershell"
+		gc.Cmd = fmt.Sprintf("tar.exe -czf %s -C %s .", psQuote(archive), psQuote(remoteDir))
+	case format == "zip":
+		gc.Cmd = fmt.Sprintf("cd -- %s && zip -q -r %s .", shellQuote(remoteDir), shellQuote(archive))
+	default:
+		gc.Cmd = fmt.Sprintf("tar -czf %s -C %s .", shellQuote(archive), shellQuote(remoteDir))
+	}
+	if _, err := runGuestCheck(ctx, g, gc); err != nil {
+		return fmt.Errorf("failed to pack %s: %w", remoteDir, err)
+	}
+
+	body, transfer, err := g.Download(ctx, archive)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	p := newProgress(remoteDir, transfer.Size, localDir == "-")
+	defer p.Finish()
+	r := p.Reader(body)
+
+	h := sha256.New()
+	verify := func() error {
+		if !cpVerify {
+			return nil
+		}
+		return verifySum(ctx, g, archive, hex.EncodeToString(h.Sum(nil)))
+	}
+
+	if localDir == "-" {
+		if _, err := io.Copy(io.MultiWriter(os.Stdout, h), r); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+		return verify()
+	}
+
+	// Spool first: zip needs random access, and a bad archive should not be
+	// half unpacked
+	spool, size, err := spoolLocal(io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+	if err := verify(); err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Unpacking a %d byte %s archive into %s...\n", size, format, localDir)
+	}
+	if err := unpackLocal(spool, size, format, localDir); err != nil {
+		return fmt.Errorf("failed to unpack into %s: %w", localDir, err)
+	}
+	return nil
+}
+
+// packLocal writes the regular files and directories under root to w
+func packLocal(root, format string, w io.Writer) error {
+	var add func(rel string, info fs.FileInfo, f *os.File) error
+	var finish func() error
+
+	if format == "zip" {
+		zw := zip.NewWriter(w)
+		add = func(rel string, info fs.FileInfo, f *os.File) error {
+			hdr, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			hdr.Name = rel
+			if info.IsDir() {
+				hdr.Name += "/"
+			} else {
+				hdr.Method = zip.Deflate
+			}
+			fw, err := zw.CreateHeader(hdr)
+			if err != nil || f == nil {
+				return err
+			}
+			_, err = io.Copy(fw, f)
+			return err
+		}
+		finish = zw.Close
+	} else {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		add = func(rel string, info fs.FileInfo, f *os.File) error {
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = rel
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil || f == nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			return err
+		}
+		finish = func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+	}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case info.IsDir():
+			return add(rel, info, nil)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return add(rel, info, f)
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Skipping %s: not a regular file\n", p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return finish()
+}
+
+// unpackLocal extracts an archive into dest, refusing entries that would land
+// outside it
+func unpackLocal(f *os.File, size int64, format, dest string) error {
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+
+	if format == "zip" {
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			err := extractEntry(dest, zf.Name, zf.FileInfo(), func() (io.ReadCloser, error) { return zf.Open() })
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = extractEntry(dest, hdr.Name, hdr.FileInfo(), func() (io.ReadCloser, error) { return io.NopCloser(tr), nil })
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractEntry(dest, name string, info fs.FileInfo, open func() (io.ReadCloser, error)) error {
+	// Archives made on Windows may use backslashes
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if clean == "." {
+		return nil
+	}
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || filepath.VolumeName(clean) != "" {
+		return fmt.Errorf("refusing unsafe archive entry %q", name)
+	}
+	target := filepath.Join(dest, filepath.FromSlash(clean))
+
+	switch {
+	case info.IsDir():
+		return os.MkdirAll(target, 0o755)
+	case !info.Mode().IsRegular():
+		// Links and devices are skipped
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm()|0o200)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
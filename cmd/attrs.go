@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+// parseMode applies a chmod mode, either octal ("755") or symbolic ("u+x,go-w"),
+// to the current permission bits. isDir enables the X permission.
+func parseMode(spec string, current uint32, isDir bool) (uint32, error) {
+	if n, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		if n > 0o7777 {
+			return 0, fmt.Errorf("invalid mode %q", spec)
+		}
+		return uint32(n), nil
+	}
+
+	mode := current & 0o7777
+	for _, clause := range strings.Split(spec, ",") {
+		i := 0
+		var who uint32
+		for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) >= 0; i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 0o4700
+			case 'g':
+				who |= 0o2070
+			case 'o':
+				who |= 0o1007
+			case 'a':
+				who |= 0o7777
+			}
+		}
+		if who == 0 {
+			who = 0o7777
+		}
+		if i == len(clause) {
+			return 0, fmt.Errorf("invalid mode %q", spec)
+		}
+
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return 0, fmt.Errorf("invalid mode %q", spec)
+			}
+			i++
+
+			var bits uint32
+			for ; i < len(clause) && strings.IndexByte("rwxXst", clause[i]) >= 0; i++ {
+				switch clause[i] {
+				case 'r':
+					bits |= 0o444
+				case 'w':
+					bits |= 0o222
+				case 'x':
+					bits |= 0o111
+				case 'X':
+					if isDir || mode&0o111 != 0 {
+						bits |= 0o111
+					}
+				case 's':
+					bits |= 0o6000
+				case 't':
+					bits |= 0o1000
+				}
+			}
+			bits &= who
+
+			switch op {
+			case '+':
+				mode |= bits
+			case '-':
+				mode &^= bits
+			case '=':
+				mode = mode&^who | bits
+			}
+		}
+	}
+	return mode, nil
+}
+
+// resolveOwner parses "user", "user:group" or ":group" into numeric IDs.
+// Names are looked up in the guest's /etc/passwd and /etc/group. Nil means unchanged.
+func resolveOwner(ctx context.Context, g *vsphere.Guest, spec string) (uid, gid *int32, err error) {
+	owner, group, _ := strings.Cut(spec, ":")
+	if owner != "" {
+		if uid, err = resolveGuestID(ctx, g, "/etc/passwd", owner); err != nil {
+			return nil, nil, err
+		}
+	}
+	if group != "" {
+		if gid, err = resolveGuestID(ctx, g, "/etc/group", group); err != nil {
+			return nil, nil, err
+		}
+	}
+	if uid == nil && gid == nil {
+		return nil, nil, fmt.Errorf("invalid owner %q", spec)
+	}
+	return uid, gid, nil
+}
+
+// resolveGuestID returns name as a numeric ID, looking it up in a passwd-style
+// database file in the guest when it is not already a number
+func resolveGuestID(ctx context.Context, g *vsphere.Guest, database, name string) (*int32, error) {
+	if n, err := strconv.ParseInt(name, 10, 32); err == nil {
+		id := int32(n)
+		return &id, nil
+	}
+
+	body, _, err := g.Download(ctx, database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s to resolve %q: %w", database, name, err)
+	}
+	defer body.Close()
+
+	// name:password:id:...
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 2 && fields[0] == name {
+			n, err := strconv.ParseInt(fields[2], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id for %q in %s", name, database)
+			}
+			id := int32(n)
+			return &id, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%q not found in %s (only local accounts can be resolved; use a numeric id)", name, database)
+}
+
+// windowsAttributes maps a POSIX mode onto the Windows read-only flag, which
+// is set when the owner cannot write
+func windowsAttributes(mode uint32) *types.GuestWindowsFileAttributes {
+	readOnly := mode&0o200 == 0
+	return &types.GuestWindowsFileAttributes{ReadOnly: &readOnly}
+}
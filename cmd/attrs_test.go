@@ -0,0 +1,57 @@
+package cmd
+
+import "testing"
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		spec    string
+		current uint32
+		isDir   bool
+		want    uint32
+		wantErr bool
+	}{
+		{spec: "755", want: 0o755},
+		{spec: "0644", current: 0o777, want: 0o644},
+		{spec: "4755", want: 0o4755},
+		{spec: "17777", wantErr: true},
+		{spec: "u+x", current: 0o644, want: 0o744},
+		{spec: "+x", current: 0o644, want: 0o755},
+		{spec: "a+x", current: 0o644, want: 0o755},
+		{spec: "go-w", current: 0o666, want: 0o644},
+		{spec: "u=rw,go=r", current: 0o777, want: 0o644},
+		{spec: "o=", current: 0o777, want: 0o770},
+		{spec: "u+x,g-r", current: 0o644, want: 0o704},
+		{spec: "u-w+x", current: 0o644, want: 0o544},
+		{spec: "+X", current: 0o644, want: 0o644},
+		{spec: "+X", current: 0o644, isDir: true, want: 0o755},
+		{spec: "+X", current: 0o744, want: 0o755},
+		{spec: "u+s", current: 0o755, want: 0o4755},
+		{spec: "g+s", current: 0o755, want: 0o2755},
+		{spec: "+t", current: 0o777, want: 0o1777},
+		{spec: "u+x", current: 0o100644, want: 0o744},
+		// Windows files start from 0o666, or 0o444 when read-only
+		{spec: "u+x", current: 0o666, want: 0o766},
+		{spec: "a-w", current: 0o666, want: 0o444},
+		{spec: "u+w", current: 0o444, want: 0o644},
+		{spec: "", wantErr: true},
+		{spec: "u", wantErr: true},
+		{spec: "u+q", wantErr: true},
+		{spec: "z+x", wantErr: true},
+		{spec: "u+x,", wantErr: true},
+		{spec: "999", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMode(tt.spec, tt.current, tt.isDir)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseMode(%q, %o, %t) = %o, want an error", tt.spec, tt.current, tt.isDir, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMode(%q, %o, %t) failed: %v", tt.spec, tt.current, tt.isDir, err)
+		} else if got != tt.want {
+			t.Errorf("parseMode(%q, %o, %t) = %04o, want %04o", tt.spec, tt.current, tt.isDir, got, tt.want)
+		}
+	}
+}
@@ -1,106 +1,264 @@
 package cmd
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
+	"os/signal"
+	"time"
 
 	"github.com/spf13/cobra"
-	"github.com/vmware/govmomi/guest"
 	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/text/encoding"
+	"vsphere-guest-cli/pkg/vsphere"
 )
 
 var (
 	catGuestUser string
 	catGuestPwd  string
+	catHead      int
+	catTail      int
+	catOffset    int64
+	catLength    int64
+	catFollow    bool
+	catInterval  time.Duration
+	catVerify    bool
 )
 
 var catCmd = &cobra.Command{
 	Use:   "cat <remote-file>",
 	Short: "Read a file from the guest VM and print to stdout",
-	Args:  cobra.ExactArgs(1),
+	Long: `Prints a guest file. --head, --tail, --offset and --length select part of the
+file in the guest, so only that part is transferred. --follow keeps polling
+the file and prints data appended to it, like tail -f.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		remotePath := args[0]
-		
-		if targetVMName == "" {
-			return fmt.Errorf("--vm flag is required")
-		}
 
-		if catGuestUser == "" {
-			catGuestUser = os.Getenv("GUEST_USER")
+		if err := requireGuestArgs(&catGuestUser, &catGuestPwd); err != nil {
+			return err
 		}
-		if catGuestPwd == "" {
-			catGuestPwd = os.Getenv("GUEST_PASSWORD")
+		if catHead > 0 && catTail > 0 {
+			return fmt.Errorf("--head and --tail cannot be used together")
 		}
-
-		if catGuestUser == "" || catGuestPwd == "" {
-			return fmt.Errorf("--guest-user and --guest-password (or GUEST_USER/GUEST_PASSWORD env vars) are required")
+		if catHead < 0 || catTail < 0 || catOffset < 0 {
+			return fmt.Errorf("--head, --tail and --offset must not be negative")
 		}
 
 		ctx := cmd.Context()
-		c, err := GetClient()
+		c, g, err := openGuest(ctx, catGuestUser, catGuestPwd)
 		if err != nil {
 			return err
 		}
 		defer c.Logout(ctx)
 
-		vm, err := c.FindVM(ctx, targetVMName)
-		if err != nil {
-			return fmt.Errorf("failed to find VM %s: %w", targetVMName, err)
+		r := catRange{Head: catHead, Tail: catTail, Offset: catOffset, Length: catLength}
+		if catVerify && (r.partial() || catFollow) {
+			return fmt.Errorf("--verify only applies to whole-file reads")
+		}
+		if !r.partial() && !catFollow {
+			return catWhole(ctx, g, remotePath)
+		}
+		if catFollow {
+			c.KeepAlive(5 * time.Minute)
 		}
 
-		ops := guest.NewOperationsManager(c.Client.Client, vm.Reference())
-		fileManager, err := ops.FileManager(ctx)
+		info, err := g.Stat(ctx, remotePath)
 		if err != nil {
 			return err
 		}
+		if info.Type == string(types.GuestFileTypeDirectory) {
+			return fmt.Errorf("cat %s: is a directory", remotePath)
+		}
 
-		auth := types.NamePasswordAuthentication{
-			Username: catGuestUser,
-			Password: catGuestPwd,
+		dir, err := createGuestWorkspace(ctx, g)
+		if err != nil {
+			return err
 		}
+		defer removeGuestWorkspace(ctx, g, dir)
 
-		if verbose {
-			fmt.Printf("Initiating transfer for %s...\n", remotePath)
+		// Like tail -f, following on its own starts with the last lines
+		if catFollow && !r.partial() {
+			r.Tail = 10
+		}
+		if err := readGuestRange(ctx, g, dir, remotePath, r, os.Stdout); err != nil {
+			return err
+		}
+		if !catFollow {
+			return nil
 		}
 
-		transfer, err := fileManager.InitiateFileTransferFromGuest(ctx, &auth, remotePath)
-		if err != nil {
-			return fmt.Errorf("failed to initiate file transfer: %w", err)
+		// Stop on Ctrl-C, still removing the workspace and logging out
+		followCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		return followGuestFile(followCtx, g, dir, remotePath, info.Size)
+	},
+}
+
+// catRange selects part of a file: a byte range, then its first or last lines
+type catRange struct {
+	Head, Tail     int
+	Offset, Length int64 // Length < 0 reads to the end
+}
+
+func (r catRange) partial() bool {
+	return r.Head > 0 || r.Tail > 0 || r.Offset > 0 || r.Length >= 0
+}
+
+// catWhole streams the whole file through the transfer URL
+func catWhole(ctx context.Context, g *vsphere.Guest, remotePath string) error {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Initiating transfer for %s...\n", remotePath)
+	}
+
+	body, transfer, err := g.Download(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Transfer URL: %s\n", transfer.Url)
+	}
+
+	h := sha256.New()
+	p := newProgress(remotePath, transfer.Size, true)
+	_, err = io.Copy(io.MultiWriter(os.Stdout, h), p.Reader(body))
+	p.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to read file content: %w", err)
+	}
+	if catVerify {
+		return verifySum(ctx, g, remotePath, hex.EncodeToString(h.Sum(nil)))
+	}
+	return nil
+}
+
+// readGuestRange runs a command in the guest that prints the selected part of
+// remotePath, so only that part is downloaded
+func readGuestRange(ctx context.Context, g *vsphere.Guest, dir, remotePath string, r catRange, w io.Writer) error {
+	gc := guestCommand{Dir: dir}
+	if g.IsWindows() {
+		gc.Shell = "powershell"
+		lines := r.Head > 0 || r.Tail > 0
+		switch {
+		case lines && (r.Offset > 0 || r.Length >= 0):
+			return fmt.Errorf("--head and --tail cannot be combined with --offset or --length on Windows guests")
+		case r.Head > 0:
+			gc.Cmd = fmt.Sprintf("Get-Content -LiteralPath %s -TotalCount %d", psQuote(remotePath), r.Head)
+		case r.Tail > 0:
+			gc.Cmd = fmt.Sprintf("Get-Content -LiteralPath %s -Tail %d", psQuote(remotePath), r.Tail)
+		default:
+			gc.Cmd = psByteRange(remotePath, r.Offset, r.Length)
+			// Byte ranges are passed through untouched
+			gc.Encoding = encoding.Nop
 		}
+	} else {
+		gc.Cmd = shByteRange(remotePath, r)
+	}
 
-		if verbose {
-			fmt.Printf("Transfer URL: %s\n", transfer.Url)
+	res, err := runGuestCommand(ctx, g, gc, true, w)
+	if err != nil {
+		return err
+	}
+	return res.err()
+}
+
+func shByteRange(remotePath string, r catRange) string {
+	q := shellQuote(remotePath)
+	if r.Offset == 0 && r.Length < 0 {
+		// head and tail read the file directly, so tail can seek to the end
+		switch {
+		case r.Head > 0:
+			return fmt.Sprintf("head -n %d -- %s", r.Head, q)
+		case r.Tail > 0:
+			return fmt.Sprintf("tail -n %d -- %s", r.Tail, q)
 		}
+		return "cat -- " + q
+	}
 
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	line := fmt.Sprintf("tail -c +%d -- %s", r.Offset+1, q)
+	if r.Length >= 0 {
+		line += fmt.Sprintf(" | head -c %d", r.Length)
+	}
+	switch {
+	case r.Head > 0:
+		line += fmt.Sprintf(" | head -n %d", r.Head)
+	case r.Tail > 0:
+		line += fmt.Sprintf(" | tail -n %d", r.Tail)
+	}
+	return line
+}
+
+// psByteRange returns a PowerShell script copying a byte range of a file to
+// stdout without any text conversion
+func psByteRange(remotePath string, offset, length int64) string {
+	return fmt.Sprintf(`$in = [IO.File]::Open(%s, 'Open', 'Read', 'ReadWrite')
+$out = [Console]::OpenStandardOutput()
+$null = $in.Seek(%d, 'Begin')
+$buf = New-Object byte[] 65536
+$left = [long]%d
+while ($left -ne 0) {
+  $want = $buf.Length
+  if ($left -gt 0 -and $left -lt $want) { $want = [int]$left }
+  $n = $in.Read($buf, 0, $want)
+  if ($n -le 0) { break }
+  $out.Write($buf, 0, $n)
+  if ($left -gt 0) { $left -= $n }
+}
+$out.Flush()
+$in.Close()`, psQuote(remotePath), offset, length)
+}
+
+// followGuestFile polls remotePath and prints whatever is appended after
+// offset, until ctx is cancelled
+func followGuestFile(ctx context.Context, g *vsphere.Guest, dir, remotePath string, offset int64) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(catInterval):
 		}
-		httpClient := &http.Client{Transport: tr}
 
-		resp, err := httpClient.Get(transfer.Url)
+		info, err := g.Stat(ctx, remotePath)
 		if err != nil {
-			return fmt.Errorf("failed to download file: %w", err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("download failed with status: %s", resp.Status)
+		if info.Size < offset {
+			fmt.Fprintf(os.Stderr, "cat: %s: file truncated\n", remotePath)
+			offset = 0
 		}
-
-		_, err = io.Copy(os.Stdout, resp.Body)
-		if err != nil {
-			return fmt.Errorf("failed to read file content: %w", err)
+		if info.Size == offset {
+			continue
 		}
 
-		return nil
-	},
+		r := catRange{Offset: offset, Length: info.Size - offset}
+		if err := readGuestRange(ctx, g, dir, remotePath, r, os.Stdout); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		offset = info.Size
+	}
 }
 
 func init() {
 	rootCmd.AddCommand(catCmd)
 	catCmd.Flags().StringVar(&catGuestUser, "guest-user", "", "Guest OS Username")
 	catCmd.Flags().StringVar(&catGuestPwd, "guest-password", "", "Guest OS Password")
-}
\ No newline at end of file
+	catCmd.Flags().IntVar(&catHead, "head", 0, "Print only the first N lines")
+	catCmd.Flags().IntVar(&catTail, "tail", 0, "Print only the last N lines")
+	catCmd.Flags().Int64Var(&catOffset, "offset", 0, "Start reading at this byte offset")
+	catCmd.Flags().Int64Var(&catLength, "length", -1, "Read at most this many bytes, -1 for the rest of the file")
+	catCmd.Flags().BoolVarP(&catFollow, "follow", "f", false, "Keep printing data appended to the file (default: start with the last 10 lines)")
+	catCmd.Flags().BoolVar(&catVerify, "verify", false, "Compare the SHA-256 of the printed data with the guest file")
+	catCmd.Flags().DurationVar(&catInterval, "interval", time.Second, "How often to poll the file with --follow")
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+// localSum returns the hex SHA-256 of a local file
+func localSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// guestSum computes the hex SHA-256 of one guest file with sha256sum or Get-FileHash
+func guestSum(ctx context.Context, g *vsphere.Guest, remotePath string) (string, error) {
+	dir, err := createGuestWorkspace(ctx, g)
+	if err != nil {
+		return "", err
+	}
+	defer removeGuestWorkspace(ctx, g, dir)
+
+	gc := guestCommand{Dir: dir}
+	if g.IsWindows() {
+		gc.Shell = "powershell"
+		gc.Cmd = fmt.Sprintf("(Get-FileHash -LiteralPath %s -Algorithm SHA256 -ErrorAction Stop).Hash", psQuote(remotePath))
+	} else {
+		gc.Cmd = "sha256sum -- " + shellQuote(remotePath)
+	}
+
+	var out bytes.Buffer
+	res, err := runGuestCommand(ctx, g, gc, true, &out)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(out.String())
+	if err := res.err(); err != nil {
+		return "", fmt.Errorf("failed to checksum %s in the guest: %s", remotePath, text)
+	}
+
+	hash, _, _ := strings.Cut(text, " ")
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("unexpected checksum output for %s: %q", remotePath, text)
+	}
+	return strings.ToLower(hash), nil
+}
+
+// verifySum compares the SHA-256 of remotePath in the guest with a locally
+// computed one
+func verifySum(ctx context.Context, g *vsphere.Guest, remotePath, local string) error {
+	remote, err := guestSum(ctx, g, remotePath)
+	if err != nil {
+		return err
+	}
+	if remote != local {
+		return fmt.Errorf("checksum mismatch for %s: transferred data has SHA-256 %s, guest file has %s", remotePath, local, remote)
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Verified %s (SHA-256 %s)\n", remotePath, local)
+	}
+	return nil
+}
+
+// guestTreeSums computes the SHA-256 of every file under root in the guest, in
+// one command, keyed by path relative to root with "/" separators
+func guestTreeSums(ctx context.Context, g *vsphere.Guest, dir, root string) (map[string]string, error) {
+	gc := guestCommand{Dir: dir, Encoding: encoding.Nop}
+	if g.IsWindows() {
+		gc.Shell = "powershell"
+		gc.Cmd = fmt.Sprintf(`[Console]::OutputEncoding = New-Object Text.UTF8Encoding $false
+$root = (Get-Item -LiteralPath %s -Force).FullName.TrimEnd('\')
+Get-ChildItem -LiteralPath $root -Recurse -File -Force | ForEach-Object {
+  (Get-FileHash -LiteralPath $_.FullName -Algorithm SHA256).Hash + ' ' + $_.FullName.Substring($root.Length + 1)
+}`, psQuote(root))
+	} else {
+		gc.Cmd = fmt.Sprintf("cd -- %s && find . -type f -exec sha256sum -- {} +", shellQuote(root))
+	}
+
+	var out bytes.Buffer
+	res, err := runGuestCommand(ctx, g, gc, true, &out)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.err(); err != nil {
+		return nil, fmt.Errorf("failed to checksum %s: %w: %s", root, err, strings.TrimSpace(out.String()))
+	}
+
+	// "<hash>  ./rel" from sha256sum, "<HASH> rel" from Get-FileHash
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		hash, name, ok := strings.Cut(scanner.Text(), " ")
+		// sha256sum escapes unusual names with a leading backslash; those files
+		// are simply treated as changed
+		if !ok || len(hash) != sha256.Size*2 {
+			continue
+		}
+		name = strings.TrimPrefix(strings.TrimLeft(name, " *"), "./")
+		if g.IsWindows() {
+			name = strings.ReplaceAll(strings.TrimRight(name, "\r"), "\\", "/")
+		}
+		sums[name] = strings.ToLower(hash)
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	chmodHidden   bool
+	chmodReadOnly bool
+)
+
+var chmodCmd = &cobra.Command{
+	Use:   "chmod [mode] <remote-path>...",
+	Short: "Change permissions of files in the guest VM",
+	Long: `Changes file permissions in the guest. The mode is octal (0755) or symbolic
+(u+x, go-w, a=r). On Windows guests the owner write bit maps to the read-only
+attribute, and --hidden and --read-only set the attributes directly, in which
+case the mode may be left out.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		windowsFlags := cmd.Flags().Changed("hidden") || cmd.Flags().Changed("read-only")
+
+		// Guest paths must be absolute, so a leading mode is easy to tell apart
+		var spec string
+		if !windowsFlags || !isAbsGuestPath(args[0]) {
+			spec, args = args[0], args[1:]
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("requires at least one remote path")
+		}
+
+		return runFileOp(cmd, args, func(g *vsphere.Guest, path string) error {
+			attr, err := chmodAttributes(cmd, g, spec, path)
+			if err != nil {
+				return err
+			}
+			return vsphere.FileError("chmod", path, g.Files.ChangeFileAttributes(cmd.Context(), g.Auth, path, attr))
+		})
+	},
+}
+
+var chownCmd = &cobra.Command{
+	Use:   "chown <owner>[:<group>] <remote-path>...",
+	Short: "Change the owner and group of files in the guest VM (Linux only)",
+	Long: `Changes the owner and/or group of files in the guest. Owners and groups are
+numeric ids or names from the guest's /etc/passwd and /etc/group; ":group"
+changes only the group.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		spec := args[0]
+		var uid, gid *int32
+
+		return runFileOp(cmd, args[1:], func(g *vsphere.Guest, path string) error {
+			if g.IsWindows() {
+				return fmt.Errorf("chown is not supported on Windows guests")
+			}
+			// Resolve names once for all paths
+			if uid == nil && gid == nil {
+				var err error
+				if uid, gid, err = resolveOwner(cmd.Context(), g, spec); err != nil {
+					return err
+				}
+			}
+			attr := &types.GuestPosixFileAttributes{OwnerId: uid, GroupId: gid}
+			return vsphere.FileError("chown", path, g.Files.ChangeFileAttributes(cmd.Context(), g.Auth, path, attr))
+		})
+	},
+}
+
+// chmodAttributes builds the attributes that apply spec, and the Windows
+// attribute flags, to path
+func chmodAttributes(cmd *cobra.Command, g *vsphere.Guest, spec, path string) (types.BaseGuestFileAttributes, error) {
+	var mode uint32
+	var isDir bool
+	if spec != "" {
+		// Symbolic modes are relative to the current permissions
+		if strings.ContainsAny(spec, "+-=") {
+			info, err := g.Stat(cmd.Context(), path)
+			if err != nil {
+				return nil, err
+			}
+			isDir = info.Type == string(types.GuestFileTypeDirectory)
+			switch a := info.Attributes.(type) {
+			case *types.GuestPosixFileAttributes:
+				mode = uint32(a.Permissions)
+			case *types.GuestWindowsFileAttributes:
+				// Windows only has the read-only flag; start from the mode
+				// it implies so unrelated bits do not turn it on
+				mode = 0o666
+				if a.ReadOnly != nil && *a.ReadOnly {
+					mode = 0o444
+				}
+			}
+		}
+
+		var err error
+		if mode, err = parseMode(spec, mode, isDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if !g.IsWindows() {
+		if spec == "" {
+			return nil, fmt.Errorf("--hidden and --read-only are only supported on Windows guests")
+		}
+		if mode == 0 {
+			// A zero mode is omitted from the request and would be ignored
+			return nil, fmt.Errorf("mode 0000 cannot be set through guest operations")
+		}
+		return &types.GuestPosixFileAttributes{Permissions: int64(mode)}, nil
+	}
+
+	attr := &types.GuestWindowsFileAttributes{}
+	if spec != "" {
+		attr = windowsAttributes(mode)
+	}
+	if cmd.Flags().Changed("read-only") {
+		attr.ReadOnly = &chmodReadOnly
+	}
+	if cmd.Flags().Changed("hidden") {
+		attr.Hidden = &chmodHidden
+	}
+	return attr, nil
+}
+
+// isAbsGuestPath reports whether p is an absolute POSIX or Windows path
+func isAbsGuestPath(p string) bool {
+	return strings.HasPrefix(p, "/") || strings.HasPrefix(p, "\\") || (len(p) > 2 && p[1] == ':')
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{chmodCmd, chownCmd} {
+		rootCmd.AddCommand(cmd)
+		cmd.Flags().StringVar(&fsGuestUser, "guest-user", "", "Guest OS Username")
+		cmd.Flags().StringVar(&fsGuestPwd, "guest-password", "", "Guest OS Password")
+	}
+
+	chmodCmd.Flags().BoolVar(&chmodHidden, "hidden", false, "Set (or with =false clear) the hidden attribute (Windows only)")
+	chmodCmd.Flags().BoolVar(&chmodReadOnly, "read-only", false, "Set (or with =false clear) the read-only attribute (Windows only)")
+}
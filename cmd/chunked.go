@@ -0,0 +1,377 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+// maxParts is the most parts a chunked upload may have
+const maxParts = 99999
+
+// uploadManifest records the progress of a chunked upload so an interrupted
+// transfer can resume. It is kept in the user's cache directory.
+type uploadManifest struct {
+	VM        string    `json:"vm"`
+	Local     string    `json:"local"`
+	Remote    string    `json:"remote"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	ChunkSize int64     `json:"chunk_size"`
+	SHA256    string    `json:"sha256"`
+	Done      []bool    `json:"done"`
+	Sums      []string  `json:"sums"`
+
+	path string
+}
+
+// chunkedUpload uploads localPath in parts of chunkSize bytes into a staging
+// directory next to remotePath, retrying each part, then joins the parts in the
+// guest, checks the SHA-256 of the result and moves it into place.
+func chunkedUpload(ctx context.Context, g *vsphere.Guest, localPath, remotePath string, chunkSize int64, retries int, attr types.BaseGuestFileAttributes, overwrite bool) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Part names are zero-padded to five digits so they join in order
+	if (stat.Size()+chunkSize-1)/chunkSize > maxParts {
+		return fmt.Errorf("%s needs more than %d parts of %d bytes; use a larger --chunk-size", localPath, maxParts, chunkSize)
+	}
+
+	m, err := loadUploadManifest(localPath, remotePath, stat, chunkSize)
+	if err != nil {
+		return err
+	}
+	if m.SHA256 == "" {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Hashing %s...\n", localPath)
+		}
+		if m.SHA256, err = localSum(localPath); err != nil {
+			return fmt.Errorf("failed to hash local file: %w", err)
+		}
+	}
+
+	partsDir := remotePath + ".guest-cli-parts"
+	err = g.Files.MakeDirectory(ctx, g.Auth, partsDir, false)
+	if err := vsphere.FileError("mkdir", partsDir, err); err != nil && !errors.Is(err, vsphere.ErrExists) {
+		return err
+	}
+	if err := m.checkParts(ctx, g, partsDir); err != nil {
+		return err
+	}
+
+	parts := make([]string, len(m.Done))
+	for i := range parts {
+		parts[i] = guestJoin(g, partsDir, fmt.Sprintf("part-%05d", i))
+	}
+
+	// Join into a temp name first, so a bad join never replaces the target
+	joined := remotePath + ".guest-cli-partial"
+	for repaired := false; ; repaired = true {
+		if err := m.uploadParts(ctx, g, f, parts, retries); err != nil {
+			return err
+		}
+		if err := joinParts(ctx, g, partsDir, joined); err != nil {
+			return err
+		}
+		err := verifySum(ctx, g, joined, m.SHA256)
+		if err == nil {
+			break
+		}
+		deleteGuestFile(ctx, g, joined)
+
+		// Re-send the parts that changed since they were uploaded, once. If
+		// none did, or the result is still wrong, the next run starts over.
+		if !repaired {
+			bad, cerr := m.recheckParts(ctx, g, partsDir)
+			if cerr == nil && bad > 0 {
+				if verbose {
+					fmt.Fprintf(os.Stderr, "Warning: %v; uploading %d corrupt part(s) again\n", err, bad)
+				}
+				continue
+			}
+		}
+		m.discard(ctx, g, partsDir)
+		return err
+	}
+
+	err = g.Files.MoveFile(ctx, g.Auth, joined, remotePath, overwrite)
+	if err := vsphere.FileError("upload", remotePath, err); err != nil {
+		deleteGuestFile(ctx, g, joined)
+		return err
+	}
+	if attr != nil {
+		err := g.Files.ChangeFileAttributes(ctx, g.Auth, remotePath, attr)
+		if err := vsphere.FileError("chmod", remotePath, err); err != nil {
+			return err
+		}
+	}
+
+	m.discard(ctx, g, partsDir)
+	return nil
+}
+
+// uploadParts uploads the parts not yet marked done, recording each one's
+// SHA-256 in the manifest
+func (m *uploadManifest) uploadParts(ctx context.Context, g *vsphere.Guest, f *os.File, parts []string, retries int) error {
+	p := newProgress(f.Name(), m.Size, false)
+	defer p.Finish()
+	for i, done := range m.Done {
+		if done {
+			p.Add(min(m.ChunkSize, m.Size-int64(i)*m.ChunkSize))
+		}
+	}
+
+	for i := range m.Done {
+		if m.Done[i] {
+			continue
+		}
+
+		offset := int64(i) * m.ChunkSize
+		size := min(m.ChunkSize, m.Size-offset)
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Uploading part %d/%d (%d bytes)...\n", i+1, len(m.Done), size)
+		}
+		sum, err := uploadPart(ctx, g, parts[i], io.NewSectionReader(f, offset, size), size, retries, p)
+		if err != nil {
+			return fmt.Errorf("part %d of %s: %w (run the same upload again to resume)", i+1, f.Name(), err)
+		}
+
+		m.Done[i] = true
+		m.Sums[i] = sum
+		if err := m.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadPart uploads one part, retrying with backoff, and returns the SHA-256
+// of the data sent
+func uploadPart(ctx context.Context, g *vsphere.Guest, remotePath string, r *io.SectionReader, size int64, retries int, p *progress) (string, error) {
+	backoff := vsphere.Backoff{Min: time.Second, Max: 30 * time.Second}
+	for attempt := 0; ; attempt++ {
+		h := sha256.New()
+		cr := &countingReader{r: io.TeeReader(io.NewSectionReader(r, 0, size), h)}
+		err := g.Upload(ctx, remotePath, p.Reader(cr), size, nil, true)
+		if err == nil {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}
+		// The retry sends the part again
+		p.Add(-cr.n)
+		if attempt >= retries || ctx.Err() != nil {
+			return "", err
+		}
+
+		delay := backoff.Next()
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Warning: %v; retrying in %s\n", err, delay)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// joinParts concatenates the part-NNNNN files in partsDir, in name order, into
+// target in the guest. The parts are enumerated in the guest so the command
+// stays short however many there are; the zero-padded names sort in order.
+func joinParts(ctx context.Context, g *vsphere.Guest, partsDir, target string) error {
+	dir, err := createGuestWorkspace(ctx, g)
+	if err != nil {
+		return err
+	}
+	defer removeGuestWorkspace(ctx, g, dir)
+
+	gc := guestCommand{Dir: dir}
+	if g.IsWindows() {
+		gc.Shell = "powershell"
+		gc.Cmd = fmt.Sprintf(`$ErrorActionPreference = 'Stop'
+$out = [IO.File]::Create(%s)
+try {
+  foreach ($p in Get-ChildItem -LiteralPath %s -Filter 'part-*' -File | Sort-Object Name) {
+    $in = [IO.File]::OpenRead($p.FullName)
+    try { $in.CopyTo($out) } finally { $in.Close() }
+  }
+} finally { $out.Close() }`, psQuote(target), psQuote(partsDir))
+	} else {
+		gc.Cmd = fmt.Sprintf("cat -- %s/part-* > %s", shellQuote(partsDir), shellQuote(target))
+	}
+
+	if _, err := runGuestCheck(ctx, g, gc); err != nil {
+		return fmt.Errorf("failed to join parts into %s: %w", target, err)
+	}
+	return nil
+}
+
+// loadUploadManifest returns the saved progress for this upload, or a new
+// manifest if there is none or the local file or chunk size changed
+func loadUploadManifest(localPath, remotePath string, stat os.FileInfo, chunkSize int64) (*uploadManifest, error) {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("cannot locate a directory for the upload manifest: %w", err)
+	}
+	key := sha256.Sum256([]byte(targetVMName + "\x00" + abs + "\x00" + remotePath))
+	path := filepath.Join(cache, "guest-cli", "uploads", hex.EncodeToString(key[:8])+".json")
+
+	parts := (stat.Size() + chunkSize - 1) / chunkSize
+	fresh := &uploadManifest{
+		VM:        targetVMName,
+		Local:     abs,
+		Remote:    remotePath,
+		Size:      stat.Size(),
+		ModTime:   stat.ModTime(),
+		ChunkSize: chunkSize,
+		Done:      make([]bool, max(parts, 1)),
+		Sums:      make([]string, max(parts, 1)),
+		path:      path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m uploadManifest
+	if err := json.Unmarshal(data, &m); err != nil || m.Size != fresh.Size || !m.ModTime.Equal(fresh.ModTime) ||
+		m.ChunkSize != chunkSize || len(m.Done) != len(fresh.Done) || len(m.Sums) != len(fresh.Sums) {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Discarding stale upload progress in %s\n", path)
+		}
+		return fresh, nil
+	}
+	m.path = path
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Resuming upload from %s\n", path)
+	}
+	return &m, nil
+}
+
+func (m *uploadManifest) save() error {
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, data, 0o600)
+}
+
+// checkParts clears the done mark of any part missing from the guest or with
+// the wrong size, so it is uploaded again. Parts left over from an earlier,
+// larger upload are removed, since the join takes every part in the directory.
+func (m *uploadManifest) checkParts(ctx context.Context, g *vsphere.Guest, partsDir string) error {
+	files, err := g.ListFiles(ctx, partsDir, "^part-")
+	if err != nil {
+		return vsphere.FileError("list", partsDir, err)
+	}
+	sizes := map[string]int64{}
+	for _, f := range files {
+		if n, err := strconv.Atoi(strings.TrimPrefix(f.Path, "part-")); err != nil || n >= len(m.Done) {
+			deleteGuestFile(ctx, g, guestJoin(g, partsDir, f.Path))
+			continue
+		}
+		sizes[f.Path] = f.Size
+	}
+
+	for i := range m.Done {
+		want := min(m.ChunkSize, m.Size-int64(i)*m.ChunkSize)
+		got, ok := sizes[fmt.Sprintf("part-%05d", i)]
+		m.Done[i] = m.Done[i] && ok && got == want && m.Sums[i] != ""
+	}
+	return nil
+}
+
+// recheckParts compares each part in the guest with the SHA-256 recorded when
+// it was uploaded and clears the done mark of those that differ. It returns
+// the number of bad parts.
+func (m *uploadManifest) recheckParts(ctx context.Context, g *vsphere.Guest, partsDir string) (int, error) {
+	dir, err := createGuestWorkspace(ctx, g)
+	if err != nil {
+		return 0, err
+	}
+	defer removeGuestWorkspace(ctx, g, dir)
+
+	sums, err := guestTreeSums(ctx, g, dir, partsDir)
+	if err != nil {
+		return 0, err
+	}
+	bad := 0
+	for i := range m.Done {
+		if sums[fmt.Sprintf("part-%05d", i)] != m.Sums[i] {
+			m.Done[i] = false
+			m.Sums[i] = ""
+			bad++
+		}
+	}
+	return bad, m.save()
+}
+
+// discard removes the staged parts and the manifest, so the next upload
+// starts over
+func (m *uploadManifest) discard(ctx context.Context, g *vsphere.Guest, partsDir string) {
+	if err := g.Files.DeleteDirectory(ctx, g.Auth, partsDir, true); err != nil && verbose {
+		fmt.Fprintf(os.Stderr, "Warning: failed to remove %s: %v\n", partsDir, err)
+	}
+	os.Remove(m.path)
+}
+
+// parseSize parses a byte count with an optional binary K, M or G suffix
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(num, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(num, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(num, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	cleanupGuestUser string
+	cleanupGuestPwd  string
+	cleanupOlderThan time.Duration
+	cleanupDryRun    bool
+)
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove stale guest-cli artifacts from the guest temp directory",
+	Long: `Lists the guest-cli-* files and directories left in the guest temp
+directory by earlier exec runs and removes the ones older than --older-than.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&cleanupGuestUser, &cleanupGuestPwd); err != nil {
+			return err
+		}
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, cleanupGuestUser, cleanupGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		dirs, err := guestTempDirs(ctx, g)
+		if err != nil {
+			return err
+		}
+
+		type artifact struct {
+			dir  string
+			info types.GuestFileInfo
+		}
+		var artifacts []artifact
+		for _, dir := range dirs {
+			files, err := g.ListFiles(ctx, dir, "^guest-cli-")
+			if err != nil {
+				// The legacy directory may not exist or be readable on this guest
+				if verbose {
+					fmt.Fprintf(os.Stderr, "Warning: failed to list %s: %v\n", dir, err)
+				}
+				continue
+			}
+			for _, f := range files {
+				artifacts = append(artifacts, artifact{dir, f})
+			}
+		}
+
+		cutoff := time.Now().Add(-cleanupOlderThan)
+		var failed int
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED\tSTATUS")
+		for _, a := range artifacts {
+			f := a.info
+			var modified time.Time
+			if f.Attributes != nil {
+				if mt := f.Attributes.GetGuestFileAttributes().ModificationTime; mt != nil {
+					modified = *mt
+				}
+			}
+			// Recent artifacts may belong to a command that is still running
+			if !modified.IsZero() && modified.After(cutoff) {
+				continue
+			}
+
+			path := guestJoin(g, a.dir, f.Path)
+			status := "would remove"
+			if !cleanupDryRun {
+				if f.Type == string(types.GuestFileTypeDirectory) {
+					err = g.Files.DeleteDirectory(ctx, g.Auth, path, true)
+				} else {
+					err = g.Files.DeleteFile(ctx, g.Auth, path)
+				}
+				status = "removed"
+				if err != nil {
+					status = fmt.Sprintf("failed: %v", err)
+					failed++
+				}
+			}
+
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", path, f.Size, modified.Format(time.RFC3339), status)
+		}
+		w.Flush()
+
+		if failed > 0 {
+			return fmt.Errorf("failed to remove %d artifact(s)", failed)
+		}
+		return nil
+	},
+}
+
+// guestTempDirs returns the guest user's temp directory, found by creating and
+// removing a probe file, followed by the fixed directory older versions used
+func guestTempDirs(ctx context.Context, g *vsphere.Guest) ([]string, error) {
+	probe, err := g.Files.CreateTemporaryFile(ctx, g.Auth, "guest-cli-", ".probe", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate guest temp directory: %w", err)
+	}
+	deleteGuestFile(ctx, g, probe)
+
+	dir := probe[:strings.LastIndexAny(probe, "/\\")+1]
+	legacy := "/tmp"
+	if g.IsWindows() {
+		legacy = "C:\\Windows\\Temp"
+	}
+
+	dirs := []string{dir}
+	if !strings.EqualFold(strings.TrimRight(dir, "/\\"), legacy) {
+		dirs = append(dirs, legacy)
+	}
+	return dirs, nil
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupCmd)
+	cleanupCmd.Flags().StringVar(&cleanupGuestUser, "guest-user", "", "Guest OS Username")
+	cleanupCmd.Flags().StringVar(&cleanupGuestPwd, "guest-password", "", "Guest OS Password")
+	cleanupCmd.Flags().DurationVar(&cleanupOlderThan, "older-than", time.Hour, "Only remove artifacts last modified before this long ago")
+	cleanupCmd.Flags().BoolVar(&cleanupDryRun, "dry-run", false, "List stale artifacts without removing them")
+}
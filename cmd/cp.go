@@ -2,20 +2,35 @@ package cmd
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/spf13/cobra"
-	"github.com/vmware/govmomi/guest"
 	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
 )
 
 var (
 	cpGuestUser string
 	cpGuestPwd  string
+	uploadMode  string
+	uploadOwner string
+	uploadGroup string
+	cpPreserve  bool
+	cpVerify    bool
+
+	cpArchive       bool
+	cpFormat        string
+	uploadChunkSize string
+	uploadRetries   int
+	uploadNoClobber bool
+	uploadAtomic    bool
 )
 
 var uploadCmd = &cobra.Command{
@@ -30,59 +45,75 @@ var uploadCmd = &cobra.Command{
 }
 
 var downloadCmd = &cobra.Command{
-	Use:   "download <remote-path> <local-path>",
-	Short: "Download a file from the guest VM",
-	Args:  cobra.ExactArgs(2),
+	Use:   "download <remote-path>... <local-path>",
+	Short: "Download files from the guest VM",
+	Long: `Downloads a guest file. With several remote paths, or wildcards (*, ? and
+[...]) in the last component of one, the files are saved into the local
+directory, keeping their paths below the sources' common directory unless
+--flatten is given.`,
+	Args: cobra.MinimumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		remotePath := args[0]
-		localPath := args[1]
+		sources, localPath := args[:len(args)-1], args[len(args)-1]
+		if len(sources) > 1 || hasGlob(sources[0]) {
+			if cpArchive {
+				return fmt.Errorf("--archive takes a single remote directory")
+			}
+			return runMultiDownload(cmd.Context(), sources, localPath)
+		}
+
+		remotePath := sources[0]
+		// Like cp, downloading into an existing directory keeps the file's name
+		if info, err := os.Stat(localPath); err == nil && info.IsDir() && !cpArchive {
+			_, base := vsphere.SplitPath(remotePath)
+			localPath = filepath.Join(localPath, base)
+		}
 		return runTransfer(cmd.Context(), localPath, remotePath, false)
 	},
 }
 
 func runTransfer(ctx context.Context, localPath, remotePath string, upload bool) error {
-	if targetVMName == "" {
-		return fmt.Errorf("--vm flag is required")
+	if err := requireGuestArgs(&cpGuestUser, &cpGuestPwd); err != nil {
+		return err
 	}
 
-	if cpGuestUser == "" {
-		cpGuestUser = os.Getenv("GUEST_USER")
+	var format string
+	if cpArchive {
+		var err error
+		if format, err = archiveFormat(cpFormat); err != nil {
+			return err
+		}
 	}
-	if cpGuestPwd == "" {
-		cpGuestPwd = os.Getenv("GUEST_PASSWORD")
+
+	if cpArchive && (uploadNoClobber || uploadAtomic) {
+		return fmt.Errorf("--no-clobber and --atomic cannot be used with --archive")
 	}
 
-	if cpGuestUser == "" || cpGuestPwd == "" {
-		return fmt.Errorf("--guest-user and --guest-password (or GUEST_USER/GUEST_PASSWORD env vars) are required")
+	var chunkSize int64
+	if upload && uploadChunkSize != "" {
+		var err error
+		if chunkSize, err = parseSize(uploadChunkSize); err != nil {
+			return fmt.Errorf("--chunk-size: %w", err)
+		}
 	}
 
-	c, err := GetClient()
+	c, g, err := openGuest(ctx, cpGuestUser, cpGuestPwd)
 	if err != nil {
 		return err
 	}
 	defer c.Logout(ctx)
 
-	vm, err := c.FindVM(ctx, targetVMName)
-	if err != nil {
-		return fmt.Errorf("failed to find VM %s: %w", targetVMName, err)
-	}
-
-	ops := guest.NewOperationsManager(c.Client.Client, vm.Reference())
-	fileManager, err := ops.FileManager(ctx)
-	if err != nil {
+	if cpArchive {
+		if upload {
+			err = archiveUpload(ctx, g, localPath, remotePath, format)
+		} else {
+			err = archiveDownload(ctx, g, remotePath, localPath, format)
+		}
+		if err == nil && verbose {
+			fmt.Fprintf(os.Stderr, "Successfully transferred %s\n", remotePath)
+		}
 		return err
 	}
 
-	auth := types.NamePasswordAuthentication{
-		Username: cpGuestUser,
-		Password: cpGuestPwd,
-	}
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
-	}
-	httpClient := &http.Client{Transport: tr}
-
 	if upload {
 		// Upload
 		f, err := os.Open(localPath)
@@ -96,65 +127,217 @@ func runTransfer(ctx context.Context, localPath, remotePath string, upload bool)
 			return err
 		}
 
-		// Overwrite?
-		attr := types.GuestFileAttributes{}
-		urlStr, err := fileManager.InitiateFileTransferToGuest(ctx, &auth, remotePath, &attr, stat.Size(), true)
+		attr, err := uploadAttributes(ctx, g, stat)
 		if err != nil {
-			return fmt.Errorf("failed to initiate upload: %w", err)
+			return err
 		}
 
-		req, err := http.NewRequest("PUT", urlStr, f)
-		if err != nil {
-			return fmt.Errorf("failed to create upload request: %w", err)
+		if uploadNoClobber {
+			// Fail before sending any data
+			if _, err := g.Stat(ctx, remotePath); err == nil {
+				return fmt.Errorf("upload %s: %w", remotePath, vsphere.ErrExists)
+			} else if !errors.Is(err, vsphere.ErrNotFound) {
+				return err
+			}
 		}
-		req.ContentLength = stat.Size()
-		
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			return fmt.Errorf("upload failed: %w", err)
+
+		if chunkSize > 0 && stat.Size() > chunkSize {
+			// Chunked uploads are always verified and moved into place
+			err = chunkedUpload(ctx, g, localPath, remotePath, chunkSize, uploadRetries, attr, !uploadNoClobber)
+		} else {
+			p := newProgress(localPath, stat.Size(), false)
+			err = uploadFile(ctx, g, p.Reader(f), stat.Size(), remotePath, attr)
+			p.Finish()
 		}
-		defer resp.Body.Close()
-		
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("upload failed with status: %s", resp.Status)
+		if err != nil {
+			return err
 		}
-		
+
 		if verbose {
-			fmt.Printf("Successfully uploaded %s to %s\n", localPath, remotePath)
+			fmt.Fprintf(os.Stderr, "Successfully uploaded %s to %s\n", localPath, remotePath)
 		}
 
-	} else {
-		// Download
-		transfer, err := fileManager.InitiateFileTransferFromGuest(ctx, &auth, remotePath)
-		if err != nil {
-			return fmt.Errorf("failed to initiate download: %w", err)
+	} else if err := downloadFile(ctx, g, remotePath, localPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// downloadFile downloads remotePath to localPath, applying --verify and --preserve.
+// The data is written to a temp name next to localPath and renamed into place
+// once complete and verified, so a failed download never leaves a partial file.
+func downloadFile(ctx context.Context, g *vsphere.Guest, remotePath, localPath string) (err error) {
+	body, transfer, err := g.Download(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// Devices such as /dev/stdout are written directly
+	dest := localPath
+	if stat, statErr := os.Stat(localPath); statErr != nil || stat.Mode().IsRegular() {
+		dir, base := filepath.Split(localPath)
+		dest = filepath.Join(dir, fmt.Sprintf(".%s.guest-cli-%d", base, time.Now().UnixNano()))
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer out.Close()
+	if dest != localPath {
+		defer func() {
+			if err != nil {
+				os.Remove(dest)
+			}
+		}()
+	}
+
+	h := sha256.New()
+	p := newProgress(remotePath, transfer.Size, false)
+	_, err = io.Copy(io.MultiWriter(out, h), p.Reader(body))
+	p.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to write local file: %w", err)
+	}
+	// Close before applying times, so nothing written afterwards bumps the mtime
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write local file: %w", err)
+	}
+
+	if cpVerify {
+		if err := verifySum(ctx, g, remotePath, hex.EncodeToString(h.Sum(nil))); err != nil {
+			return err
 		}
+	}
 
-		resp, err := httpClient.Get(transfer.Url)
-		if err != nil {
-			return fmt.Errorf("download failed: %w", err)
+	if cpPreserve {
+		if err := applyLocalAttributes(dest, transfer.Attributes); err != nil {
+			return err
 		}
-		defer resp.Body.Close()
+	}
+	if dest != localPath {
+		if err := os.Rename(dest, localPath); err != nil {
+			return fmt.Errorf("failed to write local file: %w", err)
+		}
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Successfully downloaded %s to %s\n", remotePath, localPath)
+	}
+	return nil
+}
+
+// uploadFile uploads f to remotePath in one transfer. With --atomic it is
+// uploaded to a temp name next to remotePath and renamed into place, after
+// verification if requested, so readers never see a partial file.
+func uploadFile(ctx context.Context, g *vsphere.Guest, f io.Reader, size int64, remotePath string, attr types.BaseGuestFileAttributes) error {
+	dest := remotePath
+	if uploadAtomic {
+		dir, base := vsphere.SplitPath(remotePath)
+		dest = guestJoin(g, dir, fmt.Sprintf(".%s.guest-cli-%d", base, time.Now().UnixNano()))
+	}
 
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("download failed with status: %s", resp.Status)
+	h := sha256.New()
+	err := g.Upload(ctx, dest, io.TeeReader(f, h), size, attr, !uploadNoClobber)
+	if err := vsphere.FileError("upload", remotePath, err); err != nil {
+		return err
+	}
+	if cpVerify {
+		err = verifySum(ctx, g, dest, hex.EncodeToString(h.Sum(nil)))
+	}
+	if err == nil && uploadAtomic {
+		err = vsphere.FileError("upload", remotePath, g.Files.MoveFile(ctx, g.Auth, dest, remotePath, !uploadNoClobber))
+	}
+	if err != nil && uploadAtomic {
+		deleteGuestFile(ctx, g, dest)
+	}
+	return err
+}
+
+// uploadAttributes builds the guest file attributes requested by --preserve,
+// --mode, --owner and --group. A symbolic --mode is applied to the local file's permissions.
+func uploadAttributes(ctx context.Context, g *vsphere.Guest, stat os.FileInfo) (types.BaseGuestFileAttributes, error) {
+	if !cpPreserve && uploadMode == "" && uploadOwner == "" && uploadGroup == "" {
+		return nil, nil
+	}
+
+	localPerm := uint32(stat.Mode().Perm())
+	setMode := cpPreserve || uploadMode != ""
+
+	var mode uint32
+	if cpPreserve {
+		mode = localPerm
+	}
+	if uploadMode != "" {
+		var err error
+		if mode, err = parseMode(uploadMode, localPerm, false); err != nil {
+			return nil, err
 		}
+	}
 
-		out, err := os.Create(localPath)
-		if err != nil {
-			return fmt.Errorf("failed to create local file: %w", err)
+	var mtime *time.Time
+	if cpPreserve {
+		t := stat.ModTime()
+		mtime = &t
+	}
+
+	if g.IsWindows() {
+		if uploadOwner != "" || uploadGroup != "" {
+			return nil, fmt.Errorf("--owner and --group are not supported on Windows guests")
+		}
+		attr := &types.GuestWindowsFileAttributes{}
+		if setMode {
+			attr = windowsAttributes(mode)
 		}
-		defer out.Close()
+		attr.ModificationTime = mtime
+		return attr, nil
+	}
 
-		_, err = io.Copy(out, resp.Body)
-		if err != nil {
-			return fmt.Errorf("failed to write local file: %w", err)
+	attr := &types.GuestPosixFileAttributes{Permissions: int64(mode)}
+	attr.ModificationTime = mtime
+	if uploadOwner != "" || uploadGroup != "" {
+		var err error
+		if attr.OwnerId, attr.GroupId, err = resolveOwner(ctx, g, uploadOwner+":"+uploadGroup); err != nil {
+			return nil, err
 		}
-		if verbose {
-			fmt.Printf("Successfully downloaded %s to %s\n", remotePath, localPath)
+	}
+	return attr, nil
+}
+
+// applyLocalAttributes sets the mode and times of a downloaded file from the
+// attributes the guest reported for it. Ownership is left alone.
+func applyLocalAttributes(localPath string, attr types.BaseGuestFileAttributes) error {
+	if attr == nil {
+		return nil
+	}
+
+	base := attr.GetGuestFileAttributes()
+	// Times go first, as a read-only file cannot have its times changed on Windows
+	if base.ModificationTime != nil {
+		atime := *base.ModificationTime
+		if base.AccessTime != nil {
+			atime = *base.AccessTime
+		}
+		if err := os.Chtimes(localPath, atime, *base.ModificationTime); err != nil {
+			return fmt.Errorf("failed to set local file times: %w", err)
 		}
 	}
 
+	switch a := attr.(type) {
+	case *types.GuestPosixFileAttributes:
+		if a.Permissions != 0 {
+			if err := os.Chmod(localPath, os.FileMode(a.Permissions&0o777)); err != nil {
+				return fmt.Errorf("failed to set local file mode: %w", err)
+			}
+		}
+	case *types.GuestWindowsFileAttributes:
+		if a.ReadOnly != nil && *a.ReadOnly {
+			if err := os.Chmod(localPath, 0o444); err != nil {
+				return fmt.Errorf("failed to set local file mode: %w", err)
+			}
+		}
+	}
 	return nil
 }
 
@@ -166,5 +349,19 @@ func init() {
 	for _, cmd := range []*cobra.Command{uploadCmd, downloadCmd} {
 		cmd.Flags().StringVar(&cpGuestUser, "guest-user", "", "Guest OS Username")
 		cmd.Flags().StringVar(&cpGuestPwd, "guest-password", "", "Guest OS Password")
+		cmd.Flags().BoolVar(&cpVerify, "verify", false, "Compare the SHA-256 of the transferred data with the guest file")
+		cmd.Flags().BoolVar(&cpArchive, "archive", false, "Transfer a directory tree as one archive, packed and unpacked on either side (download target - writes the archive to stdout)")
+		cmd.Flags().StringVar(&cpFormat, "format", "tar.gz", "Archive format for --archive: tar.gz or zip")
+		cmd.Flags().BoolVarP(&cpPreserve, "preserve", "p", false, "Preserve the file mode and modification time")
 	}
+
+	uploadCmd.Flags().StringVar(&uploadChunkSize, "chunk-size", "", "Upload files larger than this in resumable parts of this size (e.g. 256M), joined and verified in the guest")
+	uploadCmd.Flags().IntVar(&uploadRetries, "retries", 3, "Retries per part for chunked uploads")
+	downloadCmd.Flags().BoolVar(&downloadFlatten, "flatten", false, "Save all files directly in the local directory, dropping their remote directories")
+	downloadCmd.Flags().StringVar(&downloadCollision, "on-collision", "error", "When several files map to the same local name: error, rename (name-1.ext) or skip")
+	uploadCmd.Flags().BoolVarP(&uploadNoClobber, "no-clobber", "n", false, "Fail if the remote file already exists")
+	uploadCmd.Flags().BoolVar(&uploadAtomic, "atomic", false, "Upload to a temp name next to the target and rename it into place")
+	uploadCmd.Flags().StringVar(&uploadMode, "mode", "", "Permissions for the uploaded file, octal or symbolic (e.g. 0644, u+x); on Windows only the owner write bit is used, as the read-only flag")
+	uploadCmd.Flags().StringVar(&uploadOwner, "owner", "", "Owner of the uploaded file, as a user name or uid (Linux only)")
+	uploadCmd.Flags().StringVar(&uploadGroup, "group", "", "Group of the uploaded file, as a group name or gid (Linux only)")
 }
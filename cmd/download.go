@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	downloadFlatten   bool
+	downloadCollision string
+)
+
+// hasGlob reports whether p contains shell wildcards
+func hasGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// runMultiDownload downloads several remote files, with wildcards expanded in
+// the guest, into the local directory dest
+func runMultiDownload(ctx context.Context, sources []string, dest string) error {
+	switch downloadCollision {
+	case "error", "rename", "skip":
+	default:
+		return fmt.Errorf("unknown --on-collision %q (expected error, rename or skip)", downloadCollision)
+	}
+	if info, err := os.Stat(dest); err == nil && !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dest)
+	}
+
+	if err := requireGuestArgs(&cpGuestUser, &cpGuestPwd); err != nil {
+		return err
+	}
+	c, g, err := openGuest(ctx, cpGuestUser, cpGuestPwd)
+	if err != nil {
+		return err
+	}
+	defer c.Logout(ctx)
+
+	var files []string
+	seen := map[string]bool{}
+	for _, src := range sources {
+		matches := []string{src}
+		if hasGlob(src) {
+			if matches, err = expandGuestGlob(ctx, g, src); err != nil {
+				return err
+			}
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+
+	plan, err := planLocalPaths(g, files, dest)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, f := range files {
+		localPath, ok := plan[f]
+		if !ok {
+			if verbose {
+				fmt.Fprintf(os.Stderr, "Skipping %s: name collision\n", f)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			return err
+		}
+		if err := downloadFile(ctx, g, f, localPath); err != nil {
+			errs = append(errs, vsphere.FileError("download", f, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expandGuestGlob lists the files matching a pattern whose wildcards are in its
+// last component, using the guest's own pattern matching
+func expandGuestGlob(ctx context.Context, g *vsphere.Guest, pattern string) ([]string, error) {
+	dir, base := vsphere.SplitPath(pattern)
+	if hasGlob(dir) {
+		return nil, fmt.Errorf("%s: wildcards are only supported in the last path component", pattern)
+	}
+
+	re := globRegexp(base)
+	if g.IsWindows() {
+		re = "(?i)" + re
+	}
+	entries, err := g.ListFiles(ctx, dir, re)
+	if err != nil {
+		return nil, vsphere.FileError("list", dir, err)
+	}
+
+	var matches []string
+	for _, e := range entries {
+		// Like a shell, * does not match hidden files unless asked to
+		if e.Type != string(types.GuestFileTypeFile) || (strings.HasPrefix(e.Path, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		matches = append(matches, guestJoin(g, dir, e.Path))
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no matching files", pattern)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// globRegexp translates a shell wildcard pattern (*, ? and [...] classes) into
+// an anchored regular expression
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// planLocalPaths maps each remote file to its local path under dest: its path
+// below the sources' common directory, or with --flatten just its name.
+// Files landing on the same path are handled according to --on-collision.
+func planLocalPaths(g *vsphere.Guest, files []string, dest string) (map[string]string, error) {
+	split := func(p string) []string {
+		return strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' })
+	}
+	same := func(a, b string) bool {
+		return a == b || (g.IsWindows() && strings.EqualFold(a, b))
+	}
+
+	// Components of the deepest directory containing every file
+	var common []string
+	for i, f := range files {
+		parts := split(f)
+		dir := parts[:max(len(parts)-1, 0)]
+		if i == 0 {
+			common = dir
+			continue
+		}
+		n := 0
+		for n < len(common) && n < len(dir) && same(common[n], dir[n]) {
+			n++
+		}
+		common = common[:n]
+	}
+
+	plan := map[string]string{}
+	owner := map[string]string{}
+	for _, f := range files {
+		parts := split(f)
+		rel := parts[len(parts)-1]
+		if !downloadFlatten {
+			rel = filepath.Join(parts[len(common):]...)
+		}
+		localPath := filepath.Join(dest, rel)
+
+		key := localPath
+		if g.IsWindows() {
+			key = strings.ToLower(key)
+		}
+		if prev, taken := owner[key]; taken {
+			switch downloadCollision {
+			case "error":
+				return nil, fmt.Errorf("%s and %s would both be saved as %s (use --on-collision rename or skip)", prev, f, localPath)
+			case "skip":
+				continue
+			case "rename":
+				ext := filepath.Ext(localPath)
+				stem := strings.TrimSuffix(localPath, ext)
+				for n := 1; ; n++ {
+					localPath = fmt.Sprintf("%s-%d%s", stem, n, ext)
+					key = localPath
+					if g.IsWindows() {
+						key = strings.ToLower(key)
+					}
+					if _, taken := owner[key]; !taken {
+						break
+					}
+				}
+			}
+		}
+		owner[key] = f
+		plan[f] = localPath
+	}
+	return plan, nil
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	editGuestUser string
+	editGuestPwd  string
+	editEditor    string
+)
+
+var editCmd = &cobra.Command{
+	Use:   "edit <remote-path>",
+	Short: "Edit a guest file in a local editor",
+	Long: `Downloads a guest file to a local temp file and opens it in $VISUAL or
+$EDITOR (vi, or notepad on Windows, when neither is set). If the file was
+changed, it is uploaded again with its original mode and owner. The upload is
+refused if the guest file changed while it was being edited; the edited copy
+is then kept locally. A missing file is created.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&editGuestUser, &editGuestPwd); err != nil {
+			return err
+		}
+		remotePath := args[0]
+
+		editor := editorCommand()
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, editGuestUser, editGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		before, err := g.Stat(ctx, remotePath)
+		if errors.Is(err, vsphere.ErrNotFound) {
+			before = nil
+		} else if err != nil {
+			return err
+		} else if before.Type == string(types.GuestFileTypeDirectory) {
+			return fmt.Errorf("edit %s: is a directory", remotePath)
+		}
+
+		// Keep the base name so the editor can pick its syntax from the extension
+		tmpDir, err := os.MkdirTemp("", "guest-cli-edit-*")
+		if err != nil {
+			return fmt.Errorf("failed to create local temp directory: %w", err)
+		}
+		_, base := vsphere.SplitPath(remotePath)
+		localPath := filepath.Join(tmpDir, base)
+
+		var original []byte
+		if before != nil {
+			if original, err = downloadBytes(ctx, g, remotePath); err != nil {
+				os.RemoveAll(tmpDir)
+				return err
+			}
+		}
+		if err := os.WriteFile(localPath, original, 0o600); err != nil {
+			os.RemoveAll(tmpDir)
+			return fmt.Errorf("failed to write local file: %w", err)
+		}
+
+		keep := false
+		defer func() {
+			if !keep {
+				os.RemoveAll(tmpDir)
+			}
+		}()
+
+		ed := exec.Command(editor[0], append(editor[1:], localPath)...)
+		ed.Stdin, ed.Stdout, ed.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := ed.Run(); err != nil {
+			return fmt.Errorf("editor failed: %w", err)
+		}
+
+		edited, err := os.ReadFile(localPath)
+		if err != nil {
+			return fmt.Errorf("failed to read edited file: %w", err)
+		}
+		if before != nil && bytes.Equal(original, edited) {
+			fmt.Fprintln(os.Stderr, "No changes.")
+			return nil
+		}
+
+		// Refuse to overwrite changes made in the guest in the meantime
+		after, err := g.Stat(ctx, remotePath)
+		if err != nil && !errors.Is(err, vsphere.ErrNotFound) {
+			keep = true
+			return fmt.Errorf("%w (edited copy kept at %s)", err, localPath)
+		}
+		if changedSince(before, after) {
+			keep = true
+			return fmt.Errorf("%s changed in the guest while it was being edited; edited copy kept at %s", remotePath, localPath)
+		}
+
+		// A new file must still not exist, so a concurrent create is not overwritten
+		p := newProgress(remotePath, int64(len(edited)), false)
+		err = g.Upload(ctx, remotePath, p.Reader(bytes.NewReader(edited)), int64(len(edited)), preservedAttributes(before), before != nil)
+		p.Finish()
+		if err := vsphere.FileError("edit", remotePath, err); err != nil {
+			keep = true
+			return fmt.Errorf("%w (edited copy kept at %s)", err, localPath)
+		}
+
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Saved %s (%d bytes)\n", remotePath, len(edited))
+		}
+		return nil
+	},
+}
+
+// editorCommand returns the editor command line from --editor, $VISUAL or
+// $EDITOR, falling back to the platform's default editor
+func editorCommand() []string {
+	for _, e := range []string{editEditor, os.Getenv("VISUAL"), os.Getenv("EDITOR")} {
+		if fields := strings.Fields(e); len(fields) > 0 {
+			return fields
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"notepad"}
+	}
+	return []string{"vi"}
+}
+
+func downloadBytes(ctx context.Context, g *vsphere.Guest, remotePath string) ([]byte, error) {
+	body, transfer, err := g.Download(ctx, remotePath)
+	if err != nil {
+		return nil, vsphere.FileError("edit", remotePath, err)
+	}
+	defer body.Close()
+
+	p := newProgress(remotePath, transfer.Size, false)
+	data, err := io.ReadAll(p.Reader(body))
+	p.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file content: %w", err)
+	}
+	return data, nil
+}
+
+// changedSince reports whether a guest file's size or modification time
+// differs between two stats. A nil stat means the file did not exist.
+func changedSince(before, after *types.GuestFileInfo) bool {
+	if before == nil || after == nil {
+		return before != after
+	}
+	if before.Size != after.Size {
+		return true
+	}
+	b, a := before.Attributes.GetGuestFileAttributes(), after.Attributes.GetGuestFileAttributes()
+	if b.ModificationTime == nil || a.ModificationTime == nil {
+		return b.ModificationTime != a.ModificationTime
+	}
+	return !b.ModificationTime.Equal(*a.ModificationTime)
+}
+
+// preservedAttributes returns the upload attributes that keep a file's mode,
+// owner and hidden flag
+func preservedAttributes(info *types.GuestFileInfo) types.BaseGuestFileAttributes {
+	if info == nil {
+		return nil
+	}
+	switch a := info.Attributes.(type) {
+	case *types.GuestPosixFileAttributes:
+		return &types.GuestPosixFileAttributes{Permissions: a.Permissions, OwnerId: a.OwnerId, GroupId: a.GroupId}
+	case *types.GuestWindowsFileAttributes:
+		return &types.GuestWindowsFileAttributes{Hidden: a.Hidden}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(editCmd)
+	editCmd.Flags().StringVar(&editGuestUser, "guest-user", "", "Guest OS Username")
+	editCmd.Flags().StringVar(&editGuestPwd, "guest-password", "", "Guest OS Password")
+	editCmd.Flags().StringVar(&editEditor, "editor", "", "Editor command to run (default: $VISUAL, $EDITOR, then vi or notepad)")
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Windows code pages that cmd.exe commonly writes redirected output in
+var codePages = map[int]encoding.Encoding{
+	437:   charmap.CodePage437,
+	850:   charmap.CodePage850,
+	852:   charmap.CodePage852,
+	855:   charmap.CodePage855,
+	858:   charmap.CodePage858,
+	860:   charmap.CodePage860,
+	862:   charmap.CodePage862,
+	863:   charmap.CodePage863,
+	865:   charmap.CodePage865,
+	866:   charmap.CodePage866,
+	874:   charmap.Windows874,
+	932:   japanese.ShiftJIS,
+	936:   simplifiedchinese.GBK,
+	949:   korean.EUCKR,
+	950:   traditionalchinese.Big5,
+	1250:  charmap.Windows1250,
+	1251:  charmap.Windows1251,
+	1252:  charmap.Windows1252,
+	1253:  charmap.Windows1253,
+	1254:  charmap.Windows1254,
+	1255:  charmap.Windows1255,
+	1256:  charmap.Windows1256,
+	1257:  charmap.Windows1257,
+	1258:  charmap.Windows1258,
+	65001: encoding.Nop,
+}
+
+// utf16LE strips a byte order mark when present
+var utf16LE = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+
+// lookupEncoding resolves an --encoding value. "auto" and "" return nil, meaning
+// the encoding is detected from the output and the guest code page.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return nil, nil
+	case "utf-8", "utf8", "raw":
+		return encoding.Nop, nil
+	case "utf-16le", "utf-16", "utf16":
+		return utf16LE, nil
+	}
+
+	// Bare code page numbers as printed by chcp, optionally prefixed with "cp"
+	if n, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(name), "cp")); err == nil {
+		if enc, ok := codePages[n]; ok {
+			return enc, nil
+		}
+	}
+
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported encoding %q", name)
+	}
+	return enc, nil
+}
+
+// decodeReader transcodes guest output read from r to UTF-8. With no explicit
+// encoding, UTF-16LE (as written by PowerShell) is recognised from the first
+// bytes and anything else is decoded with the guest's code page, if known.
+func decodeReader(r io.Reader, enc encoding.Encoding, codePage int) io.Reader {
+	br := bufio.NewReaderSize(r, 4096)
+	if enc == nil {
+		// Peek returns what is available along with an error at EOF
+		start, _ := br.Peek(4096)
+		switch {
+		case looksLikeUTF16LE(start):
+			enc = utf16LE
+		case codePages[codePage] != nil:
+			enc = codePages[codePage]
+		default:
+			return br
+		}
+	}
+	if enc == encoding.Nop {
+		return br
+	}
+	return transform.NewReader(br, enc.NewDecoder())
+}
+
+// looksLikeUTF16LE reports whether out has a UTF-16LE byte order mark, or is
+// mostly ASCII text with every second byte zero
+func looksLikeUTF16LE(out []byte) bool {
+	if bytes.HasPrefix(out, []byte{0xFF, 0xFE}) {
+		return true
+	}
+	pairs := len(out) / 2
+	if pairs < 2 {
+		return false
+	}
+
+	var zeros int
+	for i := 1; i < 2*pairs; i += 2 {
+		if out[i] == 0 {
+			zeros++
+		}
+	}
+	return zeros*10 >= pairs*9
+}
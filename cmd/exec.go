@@ -1,394 +1,686 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"math/rand"
-	"net/http"
 	"os"
-	"crypto/tls"
-	"net/url"
+	"strconv"
 	"strings"
-	"time"
+	"unicode/utf16"
 
 	"github.com/spf13/cobra"
-	"github.com/vmware/govmomi/guest"
-	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/text/encoding"
+	"vsphere-guest-cli/pkg/vsphere"
 )
 
 var (
-	execCmdStr     string
-	execWait       bool
-	execGuestUser  string
-	execGuestPwd   string
-	execWorkDir    string
-	execSudo       bool
+	execCmdStr    string
+	execWait      bool
+	execGuestUser string
+	execGuestPwd  string
+	execWorkDir   string
+	execSudo      bool
+	execSudoPwd   string
+	execAs        string
+	execStdin     bool
+	execKeepOut   bool
+	execShell     string
+	execEncoding  string
+	execMaxOutput int
+	execOutFile   string
 )
 
 var execCmd = &cobra.Command{
 	Use:   "exec",
 	Short: "Execute a command in the guest VM",
-	Long: `Executes a command inside the guest VM using VMware Tools.`,
+	Long: `Executes a command inside the guest VM using VMware Tools.
+
+When stdin is not a terminal (or --stdin is set), it is uploaded to the guest
+and redirected into the command, e.g. cat data.sql | guest-cli exec --cmd psql
+
+With --wait (the default), guest-cli exits with the command's exit code.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if targetVMName == "" {
-			return fmt.Errorf("--vm flag is required")
+		if err := requireGuestArgs(&execGuestUser, &execGuestPwd); err != nil {
+			return err
 		}
 		if execCmdStr == "" {
 			return fmt.Errorf("--cmd flag is required")
 		}
-		
-		if execGuestUser == "" {
-			execGuestUser = os.Getenv("GUEST_USER")
-		}
-		if execGuestPwd == "" {
-			execGuestPwd = os.Getenv("GUEST_PASSWORD")
-		}
-
-		if execGuestUser == "" || execGuestPwd == "" {
-			return fmt.Errorf("--guest-user and --guest-password (or GUEST_USER/GUEST_PASSWORD env vars) are required")
-		}
 
 		ctx := cmd.Context()
-		c, err := GetClient()
+		c, g, err := openGuest(ctx, execGuestUser, execGuestPwd)
 		if err != nil {
 			return err
 		}
 		defer c.Logout(ctx)
 
-		vm, err := c.FindVM(ctx, targetVMName)
-		if err != nil {
-			return fmt.Errorf("failed to find VM %s: %w", targetVMName, err)
+		if g.IsWindows() && (execSudo || execAs != "") {
+			return fmt.Errorf("--sudo and --as flags are not supported on Windows")
 		}
-
-		ops := guest.NewOperationsManager(c.Client.Client, vm.Reference())
-		
-		auth := types.NamePasswordAuthentication{
-			Username: execGuestUser,
-			Password: execGuestPwd,
+		if err := validateShell(g, execShell); err != nil {
+			return err
 		}
-
-		procManager, err := ops.ProcessManager(ctx)
+		enc, err := lookupEncoding(execEncoding)
 		if err != nil {
 			return err
 		}
 
-		fileManager, err := ops.FileManager(ctx)
+		// Output and stdin live in a per-command workspace so one delete removes everything
+		dir, err := createGuestWorkspace(ctx, g)
 		if err != nil {
 			return err
 		}
-
-		// Determine Guest OS Family
-		var guestFamily string
-		var moVM mo.VirtualMachine
-		err = vm.Properties(ctx, vm.Reference(), []string{"guest.guestFamily"}, &moVM)
-		if err != nil {
-			fmt.Printf("Warning: Failed to fetch guest properties: %v. Assuming Linux.\n", err)
-			guestFamily = "linuxGuest"
-		} else {
-			guestFamily = moVM.Guest.GuestFamily
+		// Removed on every return, so a sudo password file never outlives a failed
+		// start; without --wait the command may still be using it
+		if execWait && !execKeepOut {
+			defer removeGuestWorkspace(ctx, g, dir)
 		}
-		
-		// Generate temp file name
-		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-		tmpFileName := fmt.Sprintf("guest-cli-%d.log", rnd.Int())
-		
-		var programPath string
-		var programArgs string
-		var remoteOutputFile string
-
-		isWindows := strings.Contains(strings.ToLower(guestFamily), "windows")
-
-		if isWindows {
-			if execSudo {
-				return fmt.Errorf("--sudo flag is not supported on Windows")
-			}
-			remoteOutputFile = "C:\\Windows\\Temp\\" + tmpFileName
-			programPath = "C:\\Windows\\System32\\cmd.exe"
-			programArgs = fmt.Sprintf("/C \"%s > %s 2>&1\"", execCmdStr, remoteOutputFile)
-		} else {
-			remoteOutputFile = "/tmp/" + tmpFileName
-			programPath = "/bin/sh"
-			
-			cmdToRun := execCmdStr
-			if execSudo {
-				// Escape single quotes in password and command for the echo | sudo pipeline
-				safePwd := strings.ReplaceAll(execGuestPwd, "'", "'\\''")
-				// safeCmd := strings.ReplaceAll(execCmdStr, "'", "'\\''") // Not strictly needed if we nest correctly, but safer?
-				// If execCmdStr contains single quotes, they might break the outer sh -c '...'
-				// The existing code: fmt.Sprintf("-c '%s > %s 2>&1'", execCmdStr, remoteOutputFile)
-				// So execCmdStr is ALREADY vulnerable to single quotes breaking out of sh -c.
-				// We should probably fix that generally, but for sudo:
-				
-				// Target: echo 'PWD' | sudo -S -p '' sh -c 'CMD'
-				// We need to construct this whole string, and THEN wrap it in the outer sh -c '... > log'
-				
-				// Let's construct the inner sudo command
-				// We need to be careful. 
-				// inner: echo 'PWD' | sudo -S -p '' sh -c 'CMD'
-				
-				// If CMD has single quotes, sh -c 'CMD' breaks.
-				// Better: Use double quotes for sh -c "CMD"? Then $vars expand.
-				
-				// Let's just wrap the sudo logic.
-				cmdToRun = fmt.Sprintf("echo '%s' | sudo -S -p '' sh -c '%s'", safePwd, execCmdStr)
-			}
 
-			// Wrapping in outer shell to capture output
-			// NOTE: If cmdToRun contains single quotes, this breaks.
-			// Ideally we should escape single quotes in cmdToRun before wrapping in ''
-			safeCmdToRun := strings.ReplaceAll(cmdToRun, "'", "'\\''")
-			programArgs = fmt.Sprintf("-c '%s > %s 2>&1'", safeCmdToRun, remoteOutputFile)
+		gc := guestCommand{
+			Cmd:          execCmdStr,
+			WorkDir:      execWorkDir,
+			Sudo:         execSudo,
+			As:           execAs,
+			SudoPassword: sudoPassword(execSudoPwd),
+			Shell:        execShell,
+			Encoding:     enc,
+			MaxOutput:    execMaxOutput,
+			Dir:          dir,
 		}
 
-				if verbose {
-
-					fmt.Printf("Executing: %s %s\n", programPath, programArgs)
-
-				}
-
-		
-
-				spec := types.GuestProgramSpec{
-
-					ProgramPath:      programPath,
-
-					Arguments:        programArgs,
-
-					WorkingDirectory: execWorkDir,
-
-				}
-
-		
-
-				pid, err := procManager.StartProgram(ctx, &auth, &spec)
-
-				if err != nil {
-
-					return fmt.Errorf("failed to start program: %w", err)
-
-				}
-
-				if verbose {
-
-					fmt.Printf("Process started with PID: %d\n", pid)
-
-				}
-
-		
-
-				if execWait {
-
-					// Poll for completion
-
-					for {
-
-						select {
-
-						case <-ctx.Done():
-
-							return ctx.Err()
-
-						case <-time.After(1 * time.Second):
-
-							procs, err := procManager.ListProcesses(ctx, &auth, []int64{pid})
-
-							if err != nil {
-
-								if verbose {
-
-									fmt.Printf("Error listing process: %v\n", err)
-
-								}
-
-								continue
-
-							}
-
-							
-
-							finished := false
-
-							var exitCode int32
-
-		
-
-							if len(procs) == 0 {
-
-								if verbose {
-
-									fmt.Println("Process not found (likely finished).")
-
-								}
-
-								finished = true
-
-							} else if procs[0].EndTime != nil {
-
-								if verbose {
-
-									fmt.Printf("Process finished with exit code: %d\n", procs[0].ExitCode)
-
-								}
-
-								exitCode = procs[0].ExitCode
-
-								finished = true
-
-							}
-
-		
-
-							if finished {
-
-								// Download output
-
-								if verbose {
-
-									fmt.Printf("Downloading output from %s...\n", remoteOutputFile)
-
-								}
-
-								transfer, err := fileManager.InitiateFileTransferFromGuest(ctx, &auth, remoteOutputFile)
-
-								if err != nil {
-
-									return fmt.Errorf("failed to initiate file transfer: %w", err)
-
-								}
-
-								
-
-								if verbose {
-
-									fmt.Printf("Transfer URL: %s\n", transfer.Url)
-
-								}
-
-								
-
-								u, err := url.Parse(transfer.Url)
-
-								if err != nil {
-
-									return fmt.Errorf("failed to parse output URL: %w", err)
-
-								}
-
-								
-
-								if u == nil {
-
-									return fmt.Errorf("parsed URL is nil")
-
-								}
-
-		
-
-								// The Guest Ops URL contains a token, so we can use standard http.Get
-
-								// We use a custom client to ensure we handle TLS (insecure) if needed, 
-
-								// but the global http.DefaultClient might enforce certs.
-
-								// Let's use the govmomi client's underlying http client but via standard request if possible,
-
-								// or just create a new insecure http client if the user passed --insecure.
-
-								
-
-								// Actually, c.Client.Client.Transport is configured.
-
-								// Let's use c.Client.Client (soap) -> does it expose the http client?
-
-								// c.Client.Client is *vim25.Client.
+		if useStdin(cmd) {
+			gc.Stdin = guestJoin(g, dir, "stdin")
+			if err := uploadStdin(ctx, g, gc.Stdin); err != nil {
+				return err
+			}
+		}
 
-								// It doesn't expose the http.Client directly easily.
+		// Output streams to stdout, or to --output-file; JSON mode collects it for the result
+		var out io.Writer = os.Stdout
+		var captured *bytes.Buffer
+		if execOutFile != "" {
+			f, err := os.Create(execOutFile)
+			if err != nil {
+				return fmt.Errorf("failed to create output file: %w", err)
+			}
+			defer f.Close()
+			out = f
+		} else if jsonOutput() {
+			captured = &bytes.Buffer{}
+			out = captured
+		}
 
-								
+		res, err := runGuestCommand(ctx, g, gc, execWait, out)
+		if err != nil {
+			return err
+		}
 
-								// Let's just use a new http.Client with InsecureSkipVerify if needed.
+		if jsonOutput() {
+			result := execResult{
+				Pid:        res.Pid,
+				OutputFile: execOutFile,
+				OutputSize: res.OutputSize,
+				Truncated:  res.Truncated,
+			}
+			if res.ExitKnown {
+				result.ExitCode = &res.ExitCode
+			}
+			if captured != nil && execWait {
+				output := captured.String()
+				result.Output = &output
+			}
+			if err := printJSON(result); err != nil {
+				return err
+			}
+		}
 
-								tr := &http.Transport{
+		if !execWait {
+			return nil
+		}
+		return exitStatus(cmd, res)
+	},
+}
 
-									TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // We'll assume insecure for now as per flag
+// guestCommand describes a shell command to run in the guest
+type guestCommand struct {
+	Cmd     string
+	WorkDir string
+	Sudo    bool
+	// As runs the command as another user through sudo -u (or runuser when
+	// logged in as root). It implies Sudo.
+	As string
+	// SudoPassword is fed to sudo when it needs one. Empty means the guest password.
+	SudoPassword string
+	// Shell selects the interpreter: powershell, pwsh, cmd, sh or bash.
+	// Empty means cmd on Windows and sh elsewhere.
+	Shell string
+	// Env holds NAME=VALUE pairs exported to the command. They are set by the
+	// wrapper because GuestProgramSpec.EnvVariables replaces the whole environment.
+	Env []string
+	// Stdin is a guest path redirected into the command's standard input
+	Stdin string
+	// ScriptFile is a guest file holding the PowerShell script, run with -File
+	// instead of passing Cmd on the command line. runGuestCommand sets it when
+	// the encoded script would not fit in a Windows command line.
+	ScriptFile string
+	// MaxOutput bounds the captured output to its first and last MaxOutput/2
+	// bytes. Zero means unlimited.
+	MaxOutput int
+	// Encoding is the encoding of the command's output; nil detects it.
+	// Output is transcoded to UTF-8.
+	Encoding encoding.Encoding
+	// Dir is the guest workspace directory that receives the captured output
+	Dir string
+}
 
-								}
+// commandResult is the outcome of a guest command
+type commandResult struct {
+	Pid      int64
+	ExitCode int32
+	// ExitKnown is false when neither the exit-status file nor the process
+	// table reported how the command ended
+	ExitKnown bool
+	// OutputSize is the size of the command's output in the guest, before any truncation
+	OutputSize int64
+	Truncated  bool
+}
 
-								client := &http.Client{Transport: tr}
+// execResult is the --output json form of an exec run
+type execResult struct {
+	Pid        int64   `json:"pid"`
+	ExitCode   *int32  `json:"exit_code"`
+	Output     *string `json:"output,omitempty"`
+	OutputFile string  `json:"output_file,omitempty"`
+	OutputSize int64   `json:"output_size"`
+	Truncated  bool    `json:"truncated"`
+}
 
-								
+// err converts a non-zero or unknown exit status into an error
+func (r commandResult) err() error {
+	if !r.ExitKnown {
+		return fmt.Errorf("command finished but its exit code is unknown")
+	}
+	if r.ExitCode != 0 {
+		return &exitError{code: r.ExitCode}
+	}
+	return nil
+}
 
-								resp, err := client.Get(transfer.Url)
+// exitStatus returns res as the result of cmd. A failed guest command is not
+// a usage mistake, so cobra's usage text is suppressed for it.
+func exitStatus(cmd *cobra.Command, res commandResult) error {
+	err := res.err()
+	if err != nil {
+		cmd.SilenceUsage = true
+	}
+	return err
+}
 
-								if err != nil {
+// exitError is a guest command's non-zero exit code. Execute exits with the
+// same code, so guest-cli can stand in for the command in scripts.
+type exitError struct {
+	code int32
+}
 
-									return fmt.Errorf("failed to download file: %w", err)
+func (e *exitError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.code)
+}
 
-								}
+// exitCode returns the process exit code for e. Codes a local shell cannot
+// represent, such as Windows NTSTATUS values, are reported as 1.
+func (e *exitError) exitCode() int {
+	if e.code < 1 || e.code > 255 {
+		return 1
+	}
+	return int(e.code)
+}
 
-								defer resp.Body.Close()
+// createGuestWorkspace creates a unique guest-cli-* directory in the guest user's temp directory
+func createGuestWorkspace(ctx context.Context, g *vsphere.Guest) (string, error) {
+	dir, err := g.Files.CreateTemporaryDirectory(ctx, g.Auth, "guest-cli-", "", "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create guest temp directory: %w", err)
+	}
+	return dir, nil
+}
 
-								
+// removeGuestWorkspace deletes a workspace, reporting failures only in verbose mode
+func removeGuestWorkspace(ctx context.Context, g *vsphere.Guest, dir string) {
+	if err := g.Files.DeleteDirectory(ctx, g.Auth, dir, true); err != nil && verbose {
+		fmt.Fprintf(os.Stderr, "Warning: failed to remove %s: %v\n", dir, err)
+	}
+}
 
-								if resp.StatusCode != 200 {
+// buildProgramSpec wraps gc in the guest shell so that its output lands in
+// outputFile and its exit status in statusFile
+func buildProgramSpec(g *vsphere.Guest, gc guestCommand, outputFile, statusFile string) *types.GuestProgramSpec {
+	spec := &types.GuestProgramSpec{
+		WorkingDirectory: gc.WorkDir,
+	}
+
+	if g.IsWindows() {
+		cmdToRun := gc.Cmd
+		if gc.ScriptFile != "" {
+			cmdToRun = fmt.Sprintf("%s.exe %s -File \"%s\"", gc.Shell, powerShellFlags, gc.ScriptFile)
+		} else if isPowerShell(gc.Shell) {
+			cmdToRun = powerShellCommand(gc.Shell+".exe", gc.Cmd)
+		}
+		if gc.Stdin != "" {
+			cmdToRun = fmt.Sprintf("(%s) < \"%s\"", cmdToRun, gc.Stdin)
+		}
+		for i := len(gc.Env) - 1; i >= 0; i-- {
+			cmdToRun = fmt.Sprintf("set \"%s\" && %s", gc.Env[i], cmdToRun)
+		}
+		// /S makes cmd.exe strip only the outermost quotes, so the quoted temp paths
+		// (which may contain spaces, e.g. under C:\Users) survive intact
+		spec.ProgramPath = "C:\\Windows\\System32\\cmd.exe"
+		// call re-parses its line, so %^errorlevel% expands only after the command ran.
+		// chcp then records the code page the output was written in, and the wrapper
+		// exits with the saved code so the process table agrees with the status file.
+		spec.Arguments = fmt.Sprintf("/S /C \"%s > \"%s\" 2>&1 & call set \"GUESTCLI_RC=%%^errorlevel%%\" & call echo %%^GUESTCLI_RC%% > \"%[3]s\" & chcp >> \"%[3]s\" & call exit %%^GUESTCLI_RC%%\"", cmdToRun, outputFile, statusFile)
+		return spec
+	}
+
+	cmdToRun := gc.Cmd
+	switch gc.Shell {
+	case "bash":
+		cmdToRun = "bash -c " + shellQuote(gc.Cmd)
+	case "powershell", "pwsh":
+		// Only PowerShell 7 is available on Linux, and it installs as pwsh
+		cmdToRun = powerShellCommand("pwsh", gc.Cmd)
+	}
+	// Exported before any sudo wrapping, as sudo resets the environment
+	for i := len(gc.Env) - 1; i >= 0; i-- {
+		// Only the value is quoted, with double quotes, so the guest shell expands
+		// references like $PATH in it just as cmd.exe does with %PATH%
+		name, value, _ := strings.Cut(gc.Env[i], "=")
+		cmdToRun = fmt.Sprintf("export %s=%s; %s", name, doubleQuote(value), cmdToRun)
+	}
+	if gc.elevated() {
+		cmdToRun = elevate(g, gc, cmdToRun)
+	} else if gc.Stdin != "" {
+		// Group the command so the redirect covers every part of a compound command
+		cmdToRun = fmt.Sprintf("{ %s\n} < %s", cmdToRun, shellQuote(gc.Stdin))
+	}
+
+	// Wrapping in outer shell to capture output. The subshell keeps an "exit" in
+	// the command from skipping the status file, and the wrapper exits with the
+	// command's status so the process table agrees with the status file.
+	spec.ProgramPath = "/bin/sh"
+	spec.Arguments = fmt.Sprintf("-c %s", shellQuote(fmt.Sprintf("( %s\n) > %s 2>&1; s=$?; echo $s > %s; exit $s", cmdToRun, shellQuote(outputFile), shellQuote(statusFile))))
+	return spec
+}
 
-									return fmt.Errorf("download failed with status: %s", resp.Status)
+func (gc guestCommand) elevated() bool {
+	return gc.Sudo || gc.As != ""
+}
 
-								}
+// sudoPasswordFile is the workspace file sudo reads its password from, so the
+// password never shows up in a command line visible to ps
+func sudoPasswordFile(g *vsphere.Guest, gc guestCommand) string {
+	return guestJoin(g, gc.Dir, "sudo.pw")
+}
 
-								
+// elevate wraps cmdToRun to run as root, or as gc.As. Passwordless sudo is
+// tried first with sudo -n; otherwise the password is read from the password
+// file, which is opened on fd 3 and removed before sudo runs. Stdin is opened
+// by the calling user, as the target user may not be able to read the workspace.
+func elevate(g *vsphere.Guest, gc guestCommand, cmdToRun string) string {
+	inner := "sh -c " + shellQuote(cmdToRun)
+	stdin := ""
+	if gc.Stdin != "" {
+		stdin = " < " + shellQuote(gc.Stdin)
+	}
+
+	if g.Auth.Username == "root" {
+		if gc.As == "" {
+			return fmt.Sprintf("{ %s\n}%s", cmdToRun, stdin)
+		}
+		return fmt.Sprintf("runuser -u %s -- %s%s", shellQuote(gc.As), inner, stdin)
+	}
+
+	target := ""
+	if gc.As != "" {
+		target = "-u " + shellQuote(gc.As) + " "
+	}
+	pwFile := shellQuote(sudoPasswordFile(g, gc))
+
+	// sudo -S consumes only the password line, so stdin can follow it in the same stream
+	withPassword := fmt.Sprintf("sudo -S -p '' %s%s <&3", target, inner)
+	if gc.Stdin != "" {
+		withPassword = fmt.Sprintf("cat - %s <&3 | sudo -S -p '' %s%s", shellQuote(gc.Stdin), target, inner)
+	}
+
+	return fmt.Sprintf("exec 3< %[1]s; rm -f %[1]s\n"+
+		"if sudo -n true 2>/dev/null; then sudo -n %[2]s%[3]s%[4]s; else %[5]s; fi",
+		pwFile, target, inner, stdin, withPassword)
+}
 
-								readCloser := resp.Body
+// uploadSudoPassword writes the sudo password file for gc into its workspace
+func uploadSudoPassword(ctx context.Context, g *vsphere.Guest, gc guestCommand) error {
+	password := gc.SudoPassword
+	if password == "" {
+		password = g.Auth.Password
+	}
+	content := password + "\n"
+	attr := &types.GuestPosixFileAttributes{Permissions: 0600}
+	if err := g.Upload(ctx, sudoPasswordFile(g, gc), strings.NewReader(content), int64(len(content)), attr, true); err != nil {
+		return fmt.Errorf("failed to upload sudo password: %w", err)
+	}
+	return nil
+}
 
-								
+// sudoPassword resolves the --sudo-password flag, falling back to GUEST_SUDO_PASSWORD
+func sudoPassword(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv("GUEST_SUDO_PASSWORD")
+}
 
-								out, err := io.ReadAll(readCloser)
+// validateShell checks that shell can run on the guest's OS
+func validateShell(g *vsphere.Guest, shell string) error {
+	switch shell {
+	case "", "powershell", "pwsh":
+		return nil
+	case "cmd":
+		if !g.IsWindows() {
+			return fmt.Errorf("--shell cmd is only supported on Windows")
+		}
+	case "sh", "bash":
+		if g.IsWindows() {
+			return fmt.Errorf("--shell %s is not supported on Windows", shell)
+		}
+	default:
+		return fmt.Errorf("unknown shell %q (expected powershell, pwsh, cmd, sh or bash)", shell)
+	}
+	return nil
+}
 
-								if err != nil {
+func isPowerShell(shell string) bool {
+	return shell == "powershell" || shell == "pwsh"
+}
 
-									return fmt.Errorf("failed to read response body: %w", err)
+// powerShellFlags are passed to every PowerShell run
+const powerShellFlags = "-NoProfile -NonInteractive -ExecutionPolicy Bypass"
 
-								}
+// maxWindowsCommandLine is the longest command line cmd.exe accepts
+const maxWindowsCommandLine = 8191
 
-								
+// powerShellCommand returns a command line running script with the given
+// PowerShell executable. The script is passed with -EncodedCommand so it needs
+// no quoting.
+func powerShellCommand(exe, script string) string {
+	// -EncodedCommand takes base64 of the UTF-16LE script
+	units := utf16.Encode([]rune(powerShellScript(script)))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(buf[2*i:], u)
+	}
 
-								if verbose {
+	return fmt.Sprintf("%s %s -EncodedCommand %s", exe, powerShellFlags, base64.StdEncoding.EncodeToString(buf))
+}
 
-									fmt.Println("----- Output -----")
+// powerShellScript wraps script so a failed last statement becomes a non-zero
+// exit code, since PowerShell otherwise only reports native $LASTEXITCODE
+func powerShellScript(script string) string {
+	return "$ProgressPreference = 'SilentlyContinue'\n" +
+		"$global:LASTEXITCODE = 0\n" +
+		script + "\n" +
+		"if (-not $?) { if ($LASTEXITCODE) { exit $LASTEXITCODE } else { exit 1 } }\n" +
+		"exit $LASTEXITCODE\n"
+}
 
-								}
+// uploadPowerShellScript writes gc's script to gc.ScriptFile. The UTF-8 BOM
+// keeps Windows PowerShell from reading it in the ANSI code page.
+func uploadPowerShellScript(ctx context.Context, g *vsphere.Guest, gc guestCommand) error {
+	content := "\ufeff" + powerShellScript(gc.Cmd)
+	if err := g.Upload(ctx, gc.ScriptFile, strings.NewReader(content), int64(len(content)), nil, true); err != nil {
+		return fmt.Errorf("failed to upload script: %w", err)
+	}
+	return nil
+}
 
-								fmt.Print(string(out))
+// doubleQuote quotes s for a POSIX shell, leaving $ expansions active
+func doubleQuote(s string) string {
+	return "\"" + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + "\""
+}
 
-								if verbose {
+// shellQuote quotes s for use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
 
-									fmt.Println("\n------------------")
+// psQuote quotes s as a PowerShell single-quoted string
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
 
-								}
+// runGuestCommand starts gc in the guest and, if wait is set, waits for it to
+// finish and copies its output to w
+func runGuestCommand(ctx context.Context, g *vsphere.Guest, gc guestCommand, wait bool, w io.Writer) (commandResult, error) {
+	var res commandResult
+	remoteOutputFile := guestJoin(g, gc.Dir, "output.log")
+	remoteStatusFile := guestJoin(g, gc.Dir, "exit-status")
+	spec := buildProgramSpec(g, gc, remoteOutputFile, remoteStatusFile)
+	if g.IsWindows() && isPowerShell(gc.Shell) && len(spec.ProgramPath)+1+len(spec.Arguments) > maxWindowsCommandLine {
+		// The encoded script is too long for cmd.exe, so run it from a file
+		gc.ScriptFile = guestJoin(g, gc.Dir, "script.ps1")
+		if err := uploadPowerShellScript(ctx, g, gc); err != nil {
+			return res, err
+		}
+		spec = buildProgramSpec(g, gc, remoteOutputFile, remoteStatusFile)
+	}
 
-								
+	if gc.elevated() && !g.IsWindows() && g.Auth.Username != "root" {
+		if err := uploadSudoPassword(ctx, g, gc); err != nil {
+			return res, err
+		}
+	}
 
-								if exitCode != 0 {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Executing: %s %s\n", spec.ProgramPath, spec.Arguments)
+	}
 
-									return fmt.Errorf("command exited with code %d", exitCode)
+	pid, err := g.Processes.StartProgram(ctx, g.Auth, spec)
+	if err != nil {
+		// The wrapper removes the password file once it runs, but it never did
+		if gc.elevated() && !g.IsWindows() && g.Auth.Username != "root" {
+			deleteGuestFile(ctx, g, sudoPasswordFile(g, gc))
+		}
+		return res, fmt.Errorf("failed to start program: %w", err)
+	}
+	res.Pid = pid
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Process started with PID: %d\n", pid)
+	}
+
+	if !wait {
+		return res, nil
+	}
+
+	procs, err := g.WaitProcesses(ctx, []int64{pid})
+	if err != nil {
+		if ctx.Err() != nil {
+			// Interrupted: stop the guest process rather than leave it running
+			if err := g.Processes.TerminateProcess(context.WithoutCancel(ctx), g.Auth, pid); err != nil && verbose {
+				fmt.Fprintf(os.Stderr, "Warning: failed to terminate process %d: %v\n", pid, err)
+			}
+		}
+		return res, err
+	}
+	if info := procs[pid]; info != nil {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Process finished with exit code: %d\n", info.ExitCode)
+		}
+		res.ExitCode = info.ExitCode
+		res.ExitKnown = true
+	} else if verbose {
+		// The entry may have been reaped; the status file decides below
+		fmt.Fprintln(os.Stderr, "Process not found (likely finished).")
+	}
+
+	// The wrapper's status file records the command's own exit code, so it
+	// wins over the process table
+	code, codePage, err := readExitStatus(ctx, g, remoteStatusFile)
+	if err == nil {
+		res.ExitCode = code
+		res.ExitKnown = true
+	} else if verbose {
+		fmt.Fprintf(os.Stderr, "Failed to read exit status from %s: %v\n", remoteStatusFile, err)
+	}
+
+	// Download output
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Downloading output from %s...\n", remoteOutputFile)
+	}
+	body, transfer, err := g.Download(ctx, remoteOutputFile)
+	if err != nil {
+		return res, err
+	}
+	defer body.Close()
+	res.OutputSize = transfer.Size
+
+	// Only Windows output is auto-detected; other guests are assumed to write UTF-8
+	var r io.Reader = body
+	if gc.Encoding != nil || g.IsWindows() {
+		r = decodeReader(body, gc.Encoding, codePage)
+	}
+
+	if verbose {
+		fmt.Fprintln(os.Stderr, "----- Output -----")
+	}
+
+	// Output is streamed to w unless it has to be bounded
+	dst := w
+	var capture *headTailBuffer
+	if gc.MaxOutput > 0 {
+		capture = newHeadTailBuffer(gc.MaxOutput)
+		dst = capture
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return res, fmt.Errorf("failed to read command output: %w", err)
+	}
+	if capture != nil {
+		res.Truncated = capture.Truncated()
+		if _, err := capture.WriteTo(w); err != nil {
+			return res, fmt.Errorf("failed to write command output: %w", err)
+		}
+	}
 
-								}
+	if verbose {
+		fmt.Fprintln(os.Stderr, "\n------------------")
+	}
 
-		
+	return res, nil
+}
 
-								return nil
+// runGuestCheck runs gc to completion and returns its trimmed output. A non-zero
+// exit fails with the output as the reason.
+func runGuestCheck(ctx context.Context, g *vsphere.Guest, gc guestCommand) (string, error) {
+	var out bytes.Buffer
+	res, err := runGuestCommand(ctx, g, gc, true, &out)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(out.String())
+	if err := res.err(); err != nil {
+		if text != "" {
+			return text, fmt.Errorf("%w: %s", err, text)
+		}
+		return text, err
+	}
+	return text, nil
+}
 
-							}
+// readExitStatus reads the exit code the wrapper wrote to path. On Windows the
+// following chcp line also gives the console code page, which is 0 when absent.
+func readExitStatus(ctx context.Context, g *vsphere.Guest, path string) (int32, int, error) {
+	body, _, err := g.Download(ctx, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, 256))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	code, err := strconv.ParseInt(strings.TrimSpace(lines[0]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid exit status %q", strings.TrimSpace(lines[0]))
+	}
+
+	// "Active code page: 850", localized, so only the trailing number is used
+	var codePage int
+	if len(lines) > 1 {
+		fields := strings.Fields(lines[1])
+		if len(fields) > 0 {
+			codePage, _ = strconv.Atoi(strings.TrimSuffix(fields[len(fields)-1], "."))
+		}
+	}
+	return int32(code), codePage, nil
+}
 
-						}
+// useStdin reports whether local stdin should be fed to the guest command.
+// An explicit --stdin wins; otherwise stdin is used when it is not a terminal.
+func useStdin(cmd *cobra.Command) bool {
+	if cmd.Flags().Changed("stdin") {
+		return execStdin
+	}
+	return !isTerminal(os.Stdin)
+}
 
-					}
+// uploadStdin copies local stdin to remotePath in the guest.
+// Stdin is spooled to a local temp file first because the upload needs a size up front.
+func uploadStdin(ctx context.Context, g *vsphere.Guest, remotePath string) error {
+	spool, size, err := spoolLocal(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Uploading %d bytes of stdin to %s...\n", size, remotePath)
+	}
+	p := newProgress("stdin", size, false)
+	defer p.Finish()
+	if err := g.Upload(ctx, remotePath, p.Reader(spool), size, nil, true); err != nil {
+		return fmt.Errorf("failed to upload stdin: %w", err)
+	}
+	return nil
+}
 
-				}
+// spoolLocal copies readers into a local temp file and rewinds it, since a guest
+// upload needs its size up front. The caller must call removeSpool.
+func spoolLocal(readers ...io.Reader) (*os.File, int64, error) {
+	spool, err := os.CreateTemp("", "guest-cli-spool-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create local temp file: %w", err)
+	}
+
+	size, err := io.Copy(spool, io.MultiReader(readers...))
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(spool)
+		return nil, 0, fmt.Errorf("failed to spool input: %w", err)
+	}
+	return spool, size, nil
+}
 
-		return nil
-	},
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
 }
 
 func init() {
@@ -399,4 +691,12 @@ func init() {
 	execCmd.Flags().StringVar(&execGuestPwd, "guest-password", "", "Guest OS Password")
 	execCmd.Flags().StringVar(&execWorkDir, "workdir", "", "Working directory in guest")
 	execCmd.Flags().BoolVar(&execSudo, "sudo", false, "Run command as root using sudo (Linux only)")
-}
\ No newline at end of file
+	execCmd.Flags().StringVar(&execSudoPwd, "sudo-password", "", "Password for sudo, if it differs from the guest password [Env: GUEST_SUDO_PASSWORD]")
+	execCmd.Flags().StringVar(&execAs, "as", "", "Run command as another guest user via sudo -u or runuser (Linux only)")
+	execCmd.Flags().BoolVar(&execStdin, "stdin", false, "Feed local stdin to the command (default: when stdin is not a terminal)")
+	execCmd.Flags().StringVar(&execShell, "shell", "", "Interpreter: powershell, pwsh, cmd, sh or bash (default: cmd on Windows, sh elsewhere)")
+	execCmd.Flags().StringVar(&execEncoding, "encoding", "auto", "Encoding of the command output, transcoded to UTF-8 (e.g. cp850, windows-1252, utf-16le). auto detects UTF-16 and the Windows code page")
+	execCmd.Flags().IntVar(&execMaxOutput, "max-output", 0, "Keep at most this many bytes of output (first and last halves), 0 for unlimited")
+	execCmd.Flags().StringVar(&execOutFile, "output-file", "", "Stream the command output to this local file instead of stdout")
+	execCmd.Flags().BoolVar(&execKeepOut, "keep-output", false, "Leave the command's temp directory (output and stdin) in the guest for debugging")
+}
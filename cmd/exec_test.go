@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+// fakeSudo stands in for sudo: -n fails unless FAKE_SUDO_NOPASSWD=1, -S reads
+// the password from the first line of stdin, and the command runs with
+// FAKE_USER set to the target user
+const fakeSudo = `#!/bin/sh
+user=root
+while :; do
+  case "$1" in
+  -n) [ "$FAKE_SUDO_NOPASSWD" = 1 ] || exit 1; shift ;;
+  -S) IFS= read -r pw; [ "$pw" = "$FAKE_SUDO_PASSWORD" ] || { echo "sudo: incorrect password" >&2; exit 1; }; shift ;;
+  -p) shift 2 ;;
+  -u) user=$2; shift 2 ;;
+  *) break ;;
+  esac
+done
+FAKE_USER=$user exec "$@"
+`
+
+// fakeRunuser stands in for runuser -u <user> -- <command>
+const fakeRunuser = `#!/bin/sh
+user=$2
+shift 3
+FAKE_USER=$user exec "$@"
+`
+
+func TestBuildProgramSpecLinux(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("runs the generated command with /bin/sh")
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	bin := t.TempDir()
+	for name, script := range map[string]string{"sudo": fakeSudo, "runuser": fakeRunuser} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		login      string
+		gc         guestCommand
+		stdin      string
+		noPassword bool
+		wrongPw    bool
+		want       string
+		wantStatus int
+	}{
+		{
+			name: "single quotes and exit",
+			gc:   guestCommand{Cmd: `echo 'it'\''s'; echo "a'b"; exit 3`},
+			want: "it's\na'b\n", wantStatus: 3,
+		},
+		{
+			name: "exit in a compound command still writes the status",
+			gc:   guestCommand{Cmd: "if true; then exit 5; fi"},
+			want: "", wantStatus: 5,
+		},
+		{
+			name: "env values with quotes, backslashes and $",
+			gc: guestCommand{
+				Cmd: `printf '%s|%s|%s\n' "$A" "$B" "$C"`,
+				Env: []string{`A=say "hi" to $GUESTCLI_TEST_HOME`, `B=it's \back`, `C=x=y`},
+			},
+			want: `say "hi" to /home/test|it's \back|x=y` + "\n",
+		},
+		{
+			name:  "stdin with a compound command",
+			gc:    guestCommand{Cmd: "read a; echo got $a; cat"},
+			stdin: "one\ntwo\n",
+			want:  "got one\ntwo\n",
+		},
+		{
+			name:  "sudo with password and stdin",
+			login: "user",
+			gc:    guestCommand{Cmd: `echo "$FAKE_USER"; cat`, Sudo: true},
+			stdin: "data\n",
+			want:  "root\ndata\n",
+		},
+		{
+			name:       "passwordless sudo with stdin",
+			login:      "user",
+			gc:         guestCommand{Cmd: `echo "$FAKE_USER"; cat`, Sudo: true},
+			stdin:      "data\n",
+			noPassword: true,
+			want:       "root\ndata\n",
+		},
+		{
+			name:    "wrong sudo password",
+			login:   "user",
+			gc:      guestCommand{Cmd: "echo should not run", Sudo: true},
+			wrongPw: true,
+			want:    "sudo: incorrect password\n", wantStatus: 1,
+		},
+		{
+			name:  "as another user when not root",
+			login: "user",
+			gc:    guestCommand{Cmd: `echo "$FAKE_USER"; exit 4`, As: "alice"},
+			want:  "alice\n", wantStatus: 4,
+		},
+		{
+			name:  "as another user when root",
+			login: "root",
+			gc:    guestCommand{Cmd: `echo "$FAKE_USER"; cat`, As: "alice"},
+			stdin: "data\n",
+			want:  "alice\ndata\n",
+		},
+		{
+			name:  "sudo when already root runs directly",
+			login: "root",
+			gc:    guestCommand{Cmd: `echo "${FAKE_USER:-self}"; cat; exit 2`, Sudo: true},
+			stdin: "data\n",
+			want:  "self\ndata\n", wantStatus: 2,
+		},
+		{
+			name:  "sudo with env and quotes",
+			login: "user",
+			gc:    guestCommand{Cmd: `echo "$A" 'x'\''y'`, Sudo: true, Env: []string{`A=$GUESTCLI_TEST_HOME "q"`}},
+			want:  `/home/test "q" x'y` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			login := tt.login
+			if login == "" {
+				login = "user"
+			}
+			g := &vsphere.Guest{Family: "linuxGuest", Auth: &types.NamePasswordAuthentication{Username: login, Password: "secret"}}
+			gc := tt.gc
+			gc.Dir = dir
+			if tt.stdin != "" {
+				gc.Stdin = filepath.Join(dir, "stdin")
+				if err := os.WriteFile(gc.Stdin, []byte(tt.stdin), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pwFile := sudoPasswordFile(g, gc)
+			if gc.elevated() && login != "root" {
+				if err := os.WriteFile(pwFile, []byte("secret\n"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			outFile, statusFile := filepath.Join(dir, "output.log"), filepath.Join(dir, "exit-status")
+			spec := buildProgramSpec(g, gc, outFile, statusFile)
+
+			sudoPw := "secret"
+			if tt.wrongPw {
+				sudoPw = "other"
+			}
+			run := exec.Command("/bin/sh", "-c", spec.ProgramPath+" "+spec.Arguments)
+			run.Env = append(os.Environ(),
+				"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+				"GUESTCLI_TEST_HOME=/home/test",
+				"FAKE_SUDO_PASSWORD="+sudoPw,
+				"FAKE_USER=",
+			)
+			if tt.noPassword {
+				run.Env = append(run.Env, "FAKE_SUDO_NOPASSWD=1")
+			}
+			code := 0
+			if err := run.Run(); err != nil {
+				var exitErr *exec.ExitError
+				if !errors.As(err, &exitErr) {
+					t.Fatal(err)
+				}
+				code = exitErr.ExitCode()
+			}
+
+			out, err := os.ReadFile(outFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("output = %q, want %q", out, tt.want)
+			}
+			status, err := os.ReadFile(statusFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := strconv.Atoi(strings.TrimSpace(string(status))); got != tt.wantStatus {
+				t.Errorf("status file = %q, want %d", status, tt.wantStatus)
+			}
+			if code != tt.wantStatus {
+				t.Errorf("wrapper exited with %d, want %d", code, tt.wantStatus)
+			}
+			if _, err := os.Stat(pwFile); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("sudo password file still present: %v", err)
+			}
+		})
+	}
+}
+
+func TestBuildProgramSpecWindows(t *testing.T) {
+	g := &vsphere.Guest{Family: "windowsGuest", Auth: &types.NamePasswordAuthentication{Username: "Administrator"}}
+	const dir = `C:\Users\Admin User\AppData\Local\Temp\guest-cli-1`
+	outFile, statusFile := dir+`\output.log`, dir+`\exit-status`
+
+	tests := []struct {
+		name   string
+		gc     guestCommand
+		want   []string
+		absent []string
+		script string
+	}{
+		{
+			name: "cmd with env and stdin",
+			gc:   guestCommand{Cmd: "sort", Env: []string{"A=x y", "B=%PATH%"}, Stdin: dir + `\stdin`},
+			want: []string{`set "A=x y" && set "B=%PATH%" && (sort) < "` + dir + `\stdin" > "` + outFile + `" 2>&1`},
+		},
+		{
+			name:   "powershell is encoded",
+			gc:     guestCommand{Cmd: `Write-Output "it's $env:A"`, Shell: "powershell"},
+			want:   []string{"powershell.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand "},
+			script: `Write-Output "it's $env:A"`,
+		},
+		{
+			name:   "long powershell runs from a file",
+			gc:     guestCommand{Cmd: "Get-Date", Shell: "pwsh", ScriptFile: dir + `\script.ps1`},
+			want:   []string{`pwsh.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -File "` + dir + `\script.ps1" > "`},
+			absent: []string{"-EncodedCommand"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.gc.Dir = dir
+			spec := buildProgramSpec(g, tt.gc, outFile, statusFile)
+			if spec.ProgramPath != `C:\Windows\System32\cmd.exe` {
+				t.Errorf("program = %q", spec.ProgramPath)
+			}
+			args := spec.Arguments
+			if !strings.HasPrefix(args, `/S /C "`) || !strings.HasSuffix(args, `& call exit %^GUESTCLI_RC%"`) {
+				t.Errorf("arguments are not wrapped in the exit-status wrapper: %s", args)
+			}
+			if !strings.Contains(args, `call echo %^GUESTCLI_RC% > "`+statusFile+`" & chcp >> "`+statusFile+`"`) {
+				t.Errorf("arguments do not record the status in %s: %s", statusFile, args)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(args, w) {
+					t.Errorf("arguments missing %q: %s", w, args)
+				}
+			}
+			for _, a := range tt.absent {
+				if strings.Contains(args, a) {
+					t.Errorf("arguments contain %q: %s", a, args)
+				}
+			}
+			if tt.script != "" {
+				if got := decodePowerShell(t, args); !strings.Contains(got, "\n"+tt.script+"\n") {
+					t.Errorf("encoded script = %q, want it to contain %q", got, tt.script)
+				}
+			}
+		})
+	}
+}
+
+// decodePowerShell returns the script passed with -EncodedCommand in args
+func decodePowerShell(t *testing.T, args string) string {
+	t.Helper()
+	_, rest, ok := strings.Cut(args, "-EncodedCommand ")
+	if !ok {
+		t.Fatalf("no -EncodedCommand in %s", args)
+	}
+	encoded, _, _ := strings.Cut(rest, " ")
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
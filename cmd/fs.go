@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	fsGuestUser string
+	fsGuestPwd  string
+	rmForce     bool
+	mkdirParent bool
+	rmdirRecurs bool
+	mvOverwrite bool
+)
+
+var rmCmd = &cobra.Command{
+	Use:   "rm <remote-path>...",
+	Short: "Delete files in the guest VM",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runFileOp(cmd, args, func(g *vsphere.Guest, path string) error {
+			err := vsphere.FileError("rm", path, g.Files.DeleteFile(cmd.Context(), g.Auth, path))
+			if rmForce && errors.Is(err, vsphere.ErrNotFound) {
+				return nil
+			}
+			return err
+		})
+	},
+}
+
+var mkdirCmd = &cobra.Command{
+	Use:   "mkdir <remote-path>...",
+	Short: "Create directories in the guest VM",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runFileOp(cmd, args, func(g *vsphere.Guest, path string) error {
+			err := vsphere.FileError("mkdir", path, g.Files.MakeDirectory(cmd.Context(), g.Auth, path, mkdirParent))
+			// Like mkdir -p, an existing directory is not an error, but a file is
+			if mkdirParent && errors.Is(err, vsphere.ErrExists) {
+				info, statErr := g.Stat(cmd.Context(), path)
+				if statErr == nil && info.Type == string(types.GuestFileTypeDirectory) {
+					return nil
+				}
+			}
+			return err
+		})
+	},
+}
+
+var rmdirCmd = &cobra.Command{
+	Use:   "rmdir <remote-path>...",
+	Short: "Delete directories in the guest VM",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runFileOp(cmd, args, func(g *vsphere.Guest, path string) error {
+			err := g.Files.DeleteDirectory(cmd.Context(), g.Auth, path, rmdirRecurs)
+			return vsphere.FileError("rmdir", path, err)
+		})
+	},
+}
+
+var mvCmd = &cobra.Command{
+	Use:   "mv <remote-src> <remote-dst>",
+	Short: "Move or rename a file or directory in the guest VM",
+	Long: `Moves a file or directory within the guest. If the destination is an
+existing directory, the source is moved into it.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&fsGuestUser, &fsGuestPwd); err != nil {
+			return err
+		}
+		src, dst := args[0], args[1]
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, fsGuestUser, fsGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		info, err := g.Stat(ctx, src)
+		if err != nil {
+			return err
+		}
+
+		if dstInfo, err := g.Stat(ctx, dst); err == nil && dstInfo.Type == string(types.GuestFileTypeDirectory) {
+			_, base := vsphere.SplitPath(src)
+			dst = guestJoin(g, dst, base)
+		}
+
+		if info.Type == string(types.GuestFileTypeDirectory) {
+			err = g.Files.MoveDirectory(ctx, g.Auth, src, dst)
+		} else {
+			err = g.Files.MoveFile(ctx, g.Auth, src, dst, mvOverwrite)
+		}
+		if err := vsphere.FileError("mv", src, err); err != nil {
+			return err
+		}
+
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Moved %s to %s\n", src, dst)
+		}
+		return nil
+	},
+}
+
+// runFileOp applies op to every path in args over one guest session, reporting
+// each failure and continuing with the remaining paths
+func runFileOp(cmd *cobra.Command, args []string, op func(g *vsphere.Guest, path string) error) error {
+	if err := requireGuestArgs(&fsGuestUser, &fsGuestPwd); err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	c, g, err := openGuest(ctx, fsGuestUser, fsGuestPwd)
+	if err != nil {
+		return err
+	}
+	defer c.Logout(ctx)
+
+	var errs []error
+	for _, path := range args {
+		if err := op(g, path); err != nil {
+			errs = append(errs, err)
+		} else if verbose {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.Name(), path)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{rmCmd, mkdirCmd, rmdirCmd, mvCmd} {
+		rootCmd.AddCommand(cmd)
+		cmd.Flags().StringVar(&fsGuestUser, "guest-user", "", "Guest OS Username")
+		cmd.Flags().StringVar(&fsGuestPwd, "guest-password", "", "Guest OS Password")
+	}
+
+	rmCmd.Flags().BoolVarP(&rmForce, "force", "f", false, "Ignore paths that do not exist")
+	mkdirCmd.Flags().BoolVarP(&mkdirParent, "parents", "p", false, "Create parent directories as needed")
+	rmdirCmd.Flags().BoolVarP(&rmdirRecurs, "recursive", "r", false, "Delete the directory and all of its contents")
+	mvCmd.Flags().BoolVarP(&mvOverwrite, "force", "f", false, "Overwrite an existing destination file")
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+// requireGuestArgs checks for a target VM and fills in guest credentials from
+// GUEST_USER/GUEST_PASSWORD when the flags were not given.
+func requireGuestArgs(guestUser, guestPwd *string) error {
+	if targetVMName == "" {
+		return fmt.Errorf("--vm flag is required")
+	}
+
+	if *guestUser == "" {
+		*guestUser = os.Getenv("GUEST_USER")
+	}
+	if *guestPwd == "" {
+		*guestPwd = os.Getenv("GUEST_PASSWORD")
+	}
+
+	if *guestUser == "" || *guestPwd == "" {
+		return fmt.Errorf("--guest-user and --guest-password (or GUEST_USER/GUEST_PASSWORD env vars) are required")
+	}
+	return nil
+}
+
+// openGuest logs in to vSphere and prepares guest operations on the --vm target.
+// The caller must Logout the returned client.
+func openGuest(ctx context.Context, guestUser, guestPwd string) (*vsphere.Client, *vsphere.Guest, error) {
+	c, err := GetClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vm, err := c.FindVM(ctx, targetVMName)
+	if err != nil {
+		c.Logout(ctx)
+		return nil, nil, fmt.Errorf("failed to find VM %s: %w", targetVMName, err)
+	}
+
+	g, err := c.NewGuest(ctx, vm, guestUser, guestPwd)
+	if err != nil {
+		c.Logout(ctx)
+		return nil, nil, err
+	}
+
+	if err := g.LoadFamily(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to fetch guest properties: %v. Assuming Linux.\n", err)
+	}
+
+	return c, g, nil
+}
+
+// guestJoin joins a guest directory and a file name with the guest's separator
+func guestJoin(g *vsphere.Guest, dir, name string) string {
+	sep := "/"
+	if g.IsWindows() {
+		sep = "\\"
+	}
+	return strings.TrimRight(dir, sep) + sep + name
+}
+
+// deleteGuestFile removes a guest-cli artifact, reporting failures only in verbose mode
+func deleteGuestFile(ctx context.Context, g *vsphere.Guest, path string) {
+	if err := g.Files.DeleteFile(ctx, g.Auth, path); err != nil && verbose {
+		fmt.Fprintf(os.Stderr, "Warning: failed to remove %s: %v\n", path, err)
+	}
+}
+
+// isTerminal reports whether f is a character device. This covers terminals
+// as well as /dev/null, which should be treated as having no input.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
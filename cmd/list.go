@@ -36,7 +36,7 @@ var listCmd = &cobra.Command{
 		}
 
 		if verbose {
-			fmt.Printf("Found %d VMs.\n", len(vms))
+			fmt.Fprintf(os.Stderr, "Found %d VMs.\n", len(vms))
 		}
 
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// jsonOutput reports whether --output json was requested
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// headTailBuffer keeps the first and last halves of at most max bytes written
+// to it, so runaway output can be captured in bounded memory
+type headTailBuffer struct {
+	max   int
+	head  []byte
+	tail  []byte
+	total int64
+}
+
+func newHeadTailBuffer(max int) *headTailBuffer {
+	return &headTailBuffer{max: max}
+}
+
+func (b *headTailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+
+	if room := b.max/2 - len(b.head); room > 0 {
+		take := min(room, len(p))
+		b.head = append(b.head, p[:take]...)
+		p = p[take:]
+	}
+
+	keep := b.max - b.max/2
+	b.tail = append(b.tail, p...)
+	// Trim lazily so the tail is copied at most once per keep bytes written
+	if len(b.tail) > 2*keep {
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-keep:]...)
+	}
+	return n, nil
+}
+
+// Truncated reports whether more than max bytes were written
+func (b *headTailBuffer) Truncated() bool {
+	return b.total > int64(b.max)
+}
+
+// WriteTo writes the kept head and tail, separated by a marker if anything was dropped
+func (b *headTailBuffer) WriteTo(w io.Writer) (int64, error) {
+	head, tail := b.head, b.tail
+	if keep := b.max - b.max/2; len(tail) > keep {
+		tail = tail[len(tail)-keep:]
+	}
+
+	parts := [][]byte{head, tail}
+	if b.Truncated() {
+		// Cut at rune boundaries so the marker does not split a character
+		head = trimPartialRune(head)
+		for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+			tail = tail[1:]
+		}
+		omitted := b.total - int64(len(head)) - int64(len(tail))
+		marker := fmt.Sprintf("\n... [guest-cli: output truncated, %d of %d bytes omitted] ...\n", omitted, b.total)
+		parts = [][]byte{head, []byte(marker), tail}
+	}
+
+	var written int64
+	for _, part := range parts {
+		n, err := w.Write(part)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// trimPartialRune drops an incomplete UTF-8 sequence from the end of p
+func trimPartialRune(p []byte) []byte {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i]
+			}
+			break
+		}
+	}
+	return p
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress reports the state of a transfer on stderr: a bar on terminals, or
+// JSON events with --output json. A nil *progress reports nothing.
+type progress struct {
+	mu    sync.Mutex
+	label string
+	total int64
+	done  int64
+	start time.Time
+	last  time.Time
+	json  bool
+}
+
+// progressEvent is emitted on stderr in --output json mode
+type progressEvent struct {
+	Event    string `json:"event"`
+	Path     string `json:"path"`
+	Bytes    int64  `json:"bytes"`
+	Total    int64  `json:"total,omitempty"`
+	Rate     int64  `json:"rate_bytes_per_sec"`
+	ETA      int64  `json:"eta_seconds,omitempty"`
+	Finished bool   `json:"finished"`
+}
+
+// newProgress starts reporting a transfer of total bytes (0 if unknown), or
+// returns nil when stderr is not a terminal and JSON output is off. dataOnStdout
+// suppresses the bar when the transferred data itself goes to the terminal.
+func newProgress(label string, total int64, dataOnStdout bool) *progress {
+	switch {
+	case jsonOutput():
+	case !isTerminal(os.Stderr), dataOnStdout && isTerminal(os.Stdout):
+		return nil
+	}
+	now := time.Now()
+	return &progress{label: label, total: total, start: now, last: now, json: jsonOutput()}
+}
+
+// Add records n more bytes transferred; n may be negative when a failed
+// attempt is retried
+func (p *progress) Add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += n
+	interval := 200 * time.Millisecond
+	if p.json {
+		interval = time.Second
+	}
+	if now := time.Now(); now.Sub(p.last) >= interval {
+		p.last = now
+		p.render(false)
+	}
+}
+
+// Finish prints the final state
+func (p *progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.render(true)
+}
+
+// Reader counts the bytes read from r
+func (p *progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+func (p *progress) render(finished bool) {
+	elapsed := time.Since(p.start).Seconds()
+	var rate, eta float64
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+	if rate > 0 && p.total > p.done {
+		eta = float64(p.total-p.done) / rate
+	}
+
+	if p.json {
+		data, _ := json.Marshal(progressEvent{
+			Event:    "progress",
+			Path:     p.label,
+			Bytes:    p.done,
+			Total:    p.total,
+			Rate:     int64(rate),
+			ETA:      int64(eta + 0.5),
+			Finished: finished,
+		})
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+
+	line := fmt.Sprintf("%s  %s", formatBytes(p.done), formatBytes(int64(rate))+"/s")
+	if p.total > 0 {
+		pct := min(100*p.done/p.total, 100)
+		const width = 24
+		fill := int(int64(width) * pct / 100)
+		bar := strings.Repeat("=", fill) + strings.Repeat(" ", width-fill)
+		line = fmt.Sprintf("%3d%% [%s] %s/%s  %s/s", pct, bar, formatBytes(p.done), formatBytes(p.total), formatBytes(int64(rate)))
+		if !finished {
+			line += "  ETA " + formatETA(eta)
+		}
+	}
+
+	label := p.label
+	if len(label) > 30 {
+		label = "..." + label[len(label)-27:]
+	}
+	// \033[K clears what a longer previous line left behind
+	fmt.Fprintf(os.Stderr, "\r%-30s %s\033[K", label, line)
+	if finished {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
+
+// formatBytes renders n with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatETA(seconds float64) string {
+	d := time.Duration(seconds) * time.Second
+	if d >= time.Hour {
+		return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -17,6 +18,7 @@ var (
 	datacenter   string
 	targetVMName string
 	verbose      bool
+	outputFormat string
 )
 
 var rootCmd = &cobra.Command{
@@ -25,11 +27,25 @@ var rootCmd = &cobra.Command{
 	Long: `guest-cli allows you to run commands, transfer files, and interact with 
 the console of Virtual Machines running on vSphere, primarily designed for 
 AI agents and automation.`,
+	// Execute prints errors itself
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if outputFormat != "text" && outputFormat != "json" {
+			return fmt.Errorf("--output must be text or json")
+		}
+		return nil
+	},
 }
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		// Errors go to stderr so stdout stays parseable in --output json mode
+		fmt.Fprintln(os.Stderr, err)
+
+		var exit *exitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.exitCode())
+		}
 		os.Exit(1)
 	}
 }
@@ -43,8 +59,9 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&insecure, "insecure", envCfg.Insecure, "Skip SSL verification [Env: VSPHERE_INSECURE]")
 	rootCmd.PersistentFlags().StringVar(&datacenter, "datacenter", envCfg.Datacenter, "vSphere Datacenter [Env: VSPHERE_DATACENTER]")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
-	
-	// We will add the --vm flag to individual subcommands or here if it applies to all. 
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "text", "Output format: text or json")
+
+	// We will add the --vm flag to individual subcommands or here if it applies to all.
 	// Since "help" or "version" might not need it, we'll add it as a PersistentFlag but not mark it mandatory globally yet.
 	rootCmd.PersistentFlags().StringVar(&targetVMName, "vm", "", "Target Virtual Machine Name")
 }
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	runScriptGuestUser   string
+	runScriptGuestPwd    string
+	runScriptWorkDir     string
+	runScriptSudo        bool
+	runScriptSudoPwd     string
+	runScriptAs          string
+	runScriptInterpreter string
+	runScriptKeep        bool
+)
+
+var runScriptCmd = &cobra.Command{
+	Use:   "run-script <local-script> [-- args...]",
+	Short: "Upload a local script to the guest VM and run it",
+	Long: `Uploads a local script to a guest temp directory, runs it with the
+interpreter named by its shebang or extension (.sh, .py, .ps1, .bat, .cmd),
+prints its output and removes it again. The command exits with the script's
+exit code.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&runScriptGuestUser, &runScriptGuestPwd); err != nil {
+			return err
+		}
+		localPath, scriptArgs := args[0], args[1:]
+
+		f, err := os.Open(localPath)
+		if err != nil {
+			return fmt.Errorf("failed to open local file: %w", err)
+		}
+		defer f.Close()
+
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		interpreter := runScriptInterpreter
+		if interpreter == "" {
+			first, _ := bufio.NewReader(f).ReadString('\n')
+			interpreter = detectInterpreter(localPath, first)
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, runScriptGuestUser, runScriptGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		if g.IsWindows() && (runScriptSudo || runScriptAs != "") {
+			return fmt.Errorf("--sudo and --as flags are not supported on Windows")
+		}
+
+		launcher, err := scriptLauncher(g, interpreter)
+		if err != nil {
+			return err
+		}
+
+		dir, err := createGuestWorkspace(ctx, g)
+		if err != nil {
+			return err
+		}
+		if !runScriptKeep {
+			defer removeGuestWorkspace(ctx, g, dir)
+		}
+
+		// The script keeps its base name so interpreters that key off the extension still work
+		remotePath := guestJoin(g, dir, filepath.Base(localPath))
+		if runScriptAs != "" {
+			// The workspace is private to the guest user, so a script run as another
+			// user goes in its own readable temp file instead
+			remotePath, err = g.Files.CreateTemporaryFile(ctx, g.Auth, "guest-cli-", "-"+filepath.Base(localPath), "")
+			if err != nil {
+				return fmt.Errorf("failed to create guest temp file: %w", err)
+			}
+			if !runScriptKeep {
+				defer deleteGuestFile(ctx, g, remotePath)
+			}
+		}
+
+		var attr types.BaseGuestFileAttributes
+		if !g.IsWindows() {
+			attr = &types.GuestPosixFileAttributes{Permissions: 0755}
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Uploading %s to %s...\n", localPath, remotePath)
+		}
+		p := newProgress(localPath, stat.Size(), false)
+		err = g.Upload(ctx, remotePath, p.Reader(f), stat.Size(), attr, true)
+		p.Finish()
+		if err != nil {
+			return err
+		}
+
+		line := launcher + quoteGuestArg(g, remotePath)
+		for _, a := range scriptArgs {
+			line += " " + quoteGuestArg(g, a)
+		}
+
+		res, err := runGuestCommand(ctx, g, guestCommand{
+			Cmd:          line,
+			WorkDir:      runScriptWorkDir,
+			Sudo:         runScriptSudo,
+			As:           runScriptAs,
+			SudoPassword: sudoPassword(runScriptSudoPwd),
+			Dir:          dir,
+		}, true, os.Stdout)
+		if err != nil {
+			return err
+		}
+		return exitStatus(cmd, res)
+	},
+}
+
+// detectInterpreter names the interpreter for a script from its first line's
+// shebang, falling back to its extension. "direct" means the script is run as-is.
+func detectInterpreter(localPath, firstLine string) string {
+	if strings.HasPrefix(firstLine, "#!") {
+		fields := strings.Fields(strings.TrimPrefix(firstLine, "#!"))
+		if len(fields) > 0 {
+			name := path.Base(fields[0])
+			// #!/usr/bin/env python3
+			if name == "env" && len(fields) > 1 {
+				name = fields[1]
+			}
+			return interpreterForName(name)
+		}
+	}
+
+	switch strings.ToLower(filepath.Ext(localPath)) {
+	case ".ps1":
+		return "powershell"
+	case ".bat", ".cmd":
+		return "batch"
+	case ".py":
+		return "python"
+	}
+	return "sh"
+}
+
+func interpreterForName(name string) string {
+	switch {
+	case strings.HasPrefix(name, "python"):
+		return "python"
+	case name == "pwsh" || name == "powershell":
+		return "powershell"
+	case name == "bash":
+		return "bash"
+	case name == "sh" || name == "dash" || name == "ash":
+		return "sh"
+	}
+	return "direct"
+}
+
+// scriptLauncher returns the command line prefix that runs a script with
+// interpreter on the guest
+func scriptLauncher(g *vsphere.Guest, interpreter string) (string, error) {
+	switch interpreter {
+	case "direct":
+		if g.IsWindows() {
+			return "", fmt.Errorf("cannot run a script with an unknown shebang on Windows; use --interpreter")
+		}
+		return "", nil
+	case "sh", "bash":
+		if g.IsWindows() {
+			return "", fmt.Errorf("%s scripts are not supported on Windows guests", interpreter)
+		}
+		return interpreter + " ", nil
+	case "python":
+		if g.IsWindows() {
+			return "python ", nil
+		}
+		return "python3 ", nil
+	case "powershell":
+		exe := "pwsh"
+		if g.IsWindows() {
+			exe = "powershell.exe"
+		}
+		return exe + " -NoProfile -NonInteractive -ExecutionPolicy Bypass -File ", nil
+	case "batch":
+		if !g.IsWindows() {
+			return "", fmt.Errorf("batch scripts are only supported on Windows guests")
+		}
+		return "call ", nil
+	}
+	return "", fmt.Errorf("unknown interpreter %q (expected sh, bash, python, powershell, batch or direct)", interpreter)
+}
+
+// quoteGuestArg quotes a single argument for the guest's default shell
+func quoteGuestArg(g *vsphere.Guest, s string) string {
+	if !g.IsWindows() {
+		return shellQuote(s)
+	}
+	if s != "" && !strings.ContainsAny(s, " \t\"&|<>^") {
+		return s
+	}
+	return "\"" + strings.ReplaceAll(s, "\"", "\\\"") + "\""
+}
+
+func init() {
+	rootCmd.AddCommand(runScriptCmd)
+	runScriptCmd.Flags().StringVar(&runScriptGuestUser, "guest-user", "", "Guest OS Username")
+	runScriptCmd.Flags().StringVar(&runScriptGuestPwd, "guest-password", "", "Guest OS Password")
+	runScriptCmd.Flags().StringVar(&runScriptWorkDir, "workdir", "", "Working directory in guest")
+	runScriptCmd.Flags().BoolVar(&runScriptSudo, "sudo", false, "Run the script as root using sudo (Linux only)")
+	runScriptCmd.Flags().StringVar(&runScriptSudoPwd, "sudo-password", "", "Password for sudo, if it differs from the guest password [Env: GUEST_SUDO_PASSWORD]")
+	runScriptCmd.Flags().StringVar(&runScriptAs, "as", "", "Run the script as another guest user via sudo -u or runuser (Linux only)")
+	runScriptCmd.Flags().StringVar(&runScriptInterpreter, "interpreter", "", "Override the interpreter: sh, bash, python, powershell, batch or direct")
+	runScriptCmd.Flags().BoolVar(&runScriptKeep, "keep", false, "Leave the uploaded script and its output in the guest for debugging")
+}
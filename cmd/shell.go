@@ -0,0 +1,442 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	shellGuestUser string
+	shellGuestPwd  string
+	shellWorkDir   string
+	shellSudo      bool
+	shellSudoPwd   string
+	shellShell     string
+)
+
+const shellHelp = `Each line runs as a separate guest command through the exec path.
+Built-ins:
+  cd [dir]              Change the working directory (tracked locally)
+  export NAME=VALUE     Set an environment variable for later commands
+  unset NAME            Remove an environment variable
+  :env                  Show the tracked environment
+  :sudo [on|off]        Show or toggle running commands via sudo (Linux only)
+  :get <remote> [local] Download a guest file
+  :put <local> [remote] Upload a local file
+  :history              Show command history; !N or !! re-runs an entry
+  :help                 Show this help
+  exit, :quit           Leave the shell`
+
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Start an interactive shell in the guest VM",
+	Long: `Starts a REPL that runs each line in the guest over one vSphere session,
+keeping the working directory, environment and sudo state between commands.
+
+` + shellHelp,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&shellGuestUser, &shellGuestPwd); err != nil {
+			return err
+		}
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, shellGuestUser, shellGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+		c.KeepAlive(5 * time.Minute)
+
+		if g.IsWindows() && shellSudo {
+			return fmt.Errorf("--sudo flag is not supported on Windows")
+		}
+		if err := validateShell(g, shellShell); err != nil {
+			return err
+		}
+
+		dir, err := createGuestWorkspace(ctx, g)
+		if err != nil {
+			return err
+		}
+		defer removeGuestWorkspace(ctx, g, dir)
+
+		s := &guestShell{
+			g:       g,
+			dir:     dir,
+			cwd:     shellWorkDir,
+			sudo:    shellSudo,
+			sudoPwd: sudoPassword(shellSudoPwd),
+			shell:   shellShell,
+			env:     map[string]string{},
+		}
+		if s.cwd == "" {
+			if s.cwd, err = s.resolveDir(ctx, ""); err != nil {
+				return fmt.Errorf("failed to determine working directory: %w", err)
+			}
+		}
+
+		return s.run(ctx)
+	},
+}
+
+// guestShell holds the state carried between the lines of a shell session
+type guestShell struct {
+	g       *vsphere.Guest
+	dir     string
+	cwd     string
+	sudo    bool
+	sudoPwd string
+	shell   string
+	env     map[string]string
+	history []string
+}
+
+func (s *guestShell) run(ctx context.Context) error {
+	interactive := isTerminal(os.Stdin)
+	scanner := bufio.NewScanner(os.Stdin)
+
+	// Ctrl-C at the prompt must not end the session without cleaning up; while a
+	// line runs it cancels just that line
+	ignore := make(chan os.Signal, 1)
+	signal.Notify(ignore, os.Interrupt)
+	defer signal.Stop(ignore)
+
+	for {
+		if interactive {
+			fmt.Print(s.prompt())
+		}
+		if !scanner.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			recalled, err := s.recall(line)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			line = recalled
+			fmt.Println(line)
+		}
+		s.history = append(s.history, line)
+
+		if line == "exit" || line == ":quit" {
+			return nil
+		}
+
+		lineCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		err := s.dispatch(lineCtx, line)
+		interrupted := lineCtx.Err() != nil
+		stop()
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case interrupted:
+			fmt.Fprintln(os.Stderr, "^C")
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *guestShell) prompt() string {
+	mark := "$"
+	if s.g.IsWindows() {
+		mark = ">"
+	} else if s.sudo {
+		mark = "#"
+	}
+	return fmt.Sprintf("%s@%s:%s%s ", s.g.Auth.Username, targetVMName, s.cwd, mark)
+}
+
+// recall resolves a !! or !N history reference
+func (s *guestShell) recall(line string) (string, error) {
+	if len(s.history) == 0 {
+		return "", fmt.Errorf("history is empty")
+	}
+	if line == "!!" {
+		return s.history[len(s.history)-1], nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(s.history) {
+		return "", fmt.Errorf("%s: event not found", line)
+	}
+	return s.history[n-1], nil
+}
+
+func (s *guestShell) dispatch(ctx context.Context, line string) error {
+	name, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+
+	switch name {
+	case "cd":
+		target := unquote(rest)
+		if target == "" && !s.g.IsWindows() {
+			target = "~"
+		}
+		cwd, err := s.resolveDir(ctx, target)
+		if err != nil {
+			return err
+		}
+		s.cwd = cwd
+	case "export", "set":
+		// A bare "set" lists the environment in cmd.exe, so let it through
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			if name == "set" {
+				return s.exec(ctx, line)
+			}
+			return fmt.Errorf("usage: export NAME=VALUE")
+		}
+		key = strings.TrimSpace(key)
+		if !s.g.IsWindows() && !envName.MatchString(key) {
+			return fmt.Errorf("invalid variable name %q", key)
+		}
+		s.env[key] = s.expandTracked(unquote(value))
+	case "unset":
+		delete(s.env, rest)
+	case ":env":
+		for _, kv := range s.environ() {
+			fmt.Println(kv)
+		}
+	case ":sudo":
+		switch rest {
+		case "":
+		case "on":
+			if s.g.IsWindows() {
+				return fmt.Errorf("sudo is not supported on Windows")
+			}
+			s.sudo = true
+		case "off":
+			s.sudo = false
+		default:
+			return fmt.Errorf("usage: :sudo [on|off]")
+		}
+		fmt.Printf("sudo: %t\n", s.sudo)
+	case ":get":
+		return s.get(ctx, strings.Fields(rest))
+	case ":put":
+		return s.put(ctx, strings.Fields(rest))
+	case ":history":
+		for i, h := range s.history {
+			fmt.Printf("%5d  %s\n", i+1, h)
+		}
+	case ":help":
+		fmt.Println(shellHelp)
+	default:
+		return s.exec(ctx, line)
+	}
+	return nil
+}
+
+var (
+	// envName matches a valid POSIX shell variable name
+	envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// posixVarRef and windowsVarRef match variable references in a value
+	posixVarRef   = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+	windowsVarRef = regexp.MustCompile(`%([^%=]+)%`)
+)
+
+// expandTracked substitutes references to variables already set in the session
+// ($NAME and ${NAME}, or %NAME% on Windows), so PATH=$PATH:/x builds on an
+// earlier export. Other references are left for the guest shell to expand.
+func (s *guestShell) expandTracked(value string) string {
+	ref := posixVarRef
+	if s.g.IsWindows() {
+		ref = windowsVarRef
+	}
+	return ref.ReplaceAllStringFunc(value, func(m string) string {
+		sub := ref.FindStringSubmatch(m)
+		name := sub[1]
+		if name == "" && len(sub) > 2 {
+			name = sub[2]
+		}
+		for k, v := range s.env {
+			if k == name || (s.g.IsWindows() && strings.EqualFold(k, name)) {
+				return v
+			}
+		}
+		return m
+	})
+}
+
+func (s *guestShell) environ() []string {
+	env := make([]string, 0, len(s.env))
+	for k, v := range s.env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+func (s *guestShell) command(line string) guestCommand {
+	return guestCommand{
+		Cmd:          line,
+		WorkDir:      s.cwd,
+		Sudo:         s.sudo,
+		SudoPassword: s.sudoPwd,
+		Shell:        s.shell,
+		Env:          s.environ(),
+		Dir:          s.dir,
+	}
+}
+
+func (s *guestShell) exec(ctx context.Context, line string) error {
+	res, err := runGuestCommand(ctx, s.g, s.command(line), true, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if !res.ExitKnown {
+		fmt.Fprintln(os.Stderr, "[exit unknown]")
+	} else if res.ExitCode != 0 {
+		fmt.Fprintf(os.Stderr, "[exit %d]\n", res.ExitCode)
+	}
+	return nil
+}
+
+// resolveDir asks the guest for the absolute path of target relative to the
+// current directory. An empty target resolves the current (or default) directory.
+func (s *guestShell) resolveDir(ctx context.Context, target string) (string, error) {
+	var line string
+	switch {
+	case s.g.IsWindows() && target == "":
+		line = "cd"
+	case s.g.IsWindows():
+		line = fmt.Sprintf("cd /d \"%s\" && cd", target)
+	case target == "":
+		line = "pwd"
+	case target == "~" || strings.HasPrefix(target, "~/"):
+		// Leave the tilde unquoted so the guest shell expands it
+		line = "cd -- ~"
+		if rest := strings.TrimPrefix(target[1:], "/"); rest != "" {
+			line += "/" + shellQuote(rest)
+		}
+		line += " && pwd"
+	default:
+		line = fmt.Sprintf("cd -- %s && pwd", shellQuote(target))
+	}
+
+	// Use the default shell, whose cd and pwd syntax is known
+	gc := s.command(line)
+	gc.Shell = ""
+
+	var out bytes.Buffer
+	res, err := runGuestCommand(ctx, s.g, gc, true, &out)
+	if err != nil {
+		return "", err
+	}
+	if res.err() != nil {
+		return "", fmt.Errorf("cd: %s", strings.TrimSpace(out.String()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// remotePath resolves p against the shell's working directory
+func (s *guestShell) remotePath(p string) string {
+	if isAbsGuestPath(p) {
+		return p
+	}
+	return guestJoin(s.g, s.cwd, p)
+}
+
+func (s *guestShell) get(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: :get <remote> [local]")
+	}
+	remote := s.remotePath(args[0])
+	local := filepath.Base(strings.ReplaceAll(args[0], "\\", "/"))
+	if len(args) == 2 {
+		local = args[1]
+	}
+
+	body, transfer, err := s.g.Download(ctx, remote)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	out, err := os.Create(local)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer out.Close()
+
+	p := newProgress(remote, transfer.Size, false)
+	n, err := out.ReadFrom(p.Reader(body))
+	p.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to write local file: %w", err)
+	}
+	fmt.Printf("%s -> %s (%d bytes)\n", remote, local, n)
+	return nil
+}
+
+func (s *guestShell) put(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: :put <local> [remote]")
+	}
+	local := args[0]
+	remote := s.remotePath(filepath.Base(local))
+	if len(args) == 2 {
+		remote = s.remotePath(args[1])
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	p := newProgress(local, stat.Size(), false)
+	err = s.g.Upload(ctx, remote, p.Reader(f), stat.Size(), nil, true)
+	p.Finish()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s -> %s (%d bytes)\n", local, remote, stat.Size())
+	return nil
+}
+
+// unquote strips one pair of matching surrounding quotes
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+	shellCmd.Flags().StringVar(&shellGuestUser, "guest-user", "", "Guest OS Username")
+	shellCmd.Flags().StringVar(&shellGuestPwd, "guest-password", "", "Guest OS Password")
+	shellCmd.Flags().StringVar(&shellWorkDir, "workdir", "", "Initial working directory in guest")
+	shellCmd.Flags().StringVar(&shellShell, "shell", "", "Interpreter: powershell, pwsh, cmd, sh or bash (default: cmd on Windows, sh elsewhere)")
+	shellCmd.Flags().BoolVar(&shellSudo, "sudo", false, "Start with sudo enabled (Linux only)")
+	shellCmd.Flags().StringVar(&shellSudoPwd, "sudo-password", "", "Password for sudo, if it differs from the guest password [Env: GUEST_SUDO_PASSWORD]")
+}
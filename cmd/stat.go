@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+var (
+	statGuestUser string
+	statGuestPwd  string
+)
+
+// statResult is the --output json form of stat
+type statResult struct {
+	Path          string     `json:"path"`
+	Type          string     `json:"type"`
+	Size          int64      `json:"size"`
+	SymlinkTarget string     `json:"symlink_target,omitempty"`
+	Modified      *time.Time `json:"modified,omitempty"`
+	Accessed      *time.Time `json:"accessed,omitempty"`
+	// POSIX guests
+	Owner *int32 `json:"owner,omitempty"`
+	Group *int32 `json:"group,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	// Windows guests
+	Created  *time.Time `json:"created,omitempty"`
+	Hidden   *bool      `json:"hidden,omitempty"`
+	ReadOnly *bool      `json:"read_only,omitempty"`
+}
+
+var statCmd = &cobra.Command{
+	Use:   "stat <remote-path>",
+	Short: "Show information about a file in the guest VM",
+	Long: `Shows the type, size, timestamps and ownership of a guest file without
+starting a process in the guest. Exits non-zero if the file does not exist.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&statGuestUser, &statGuestPwd); err != nil {
+			return err
+		}
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, statGuestUser, statGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		info, err := g.Stat(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		res := newStatResult(args[0], info)
+		if jsonOutput() {
+			return printJSON(res)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(w, "Path:\t%s\n", res.Path)
+		fmt.Fprintf(w, "Type:\t%s\n", res.Type)
+		fmt.Fprintf(w, "Size:\t%d\n", res.Size)
+		if res.SymlinkTarget != "" {
+			fmt.Fprintf(w, "Target:\t%s\n", res.SymlinkTarget)
+		}
+		for _, t := range []struct {
+			label string
+			value *time.Time
+		}{{"Created", res.Created}, {"Modified", res.Modified}, {"Accessed", res.Accessed}} {
+			if t.value != nil {
+				fmt.Fprintf(w, "%s:\t%s\n", t.label, t.value.Format(time.RFC3339))
+			}
+		}
+		if res.Mode != "" {
+			fmt.Fprintf(w, "Mode:\t%s\n", res.Mode)
+		}
+		if res.Owner != nil {
+			fmt.Fprintf(w, "Owner:\t%d\n", *res.Owner)
+		}
+		if res.Group != nil {
+			fmt.Fprintf(w, "Group:\t%d\n", *res.Group)
+		}
+		if res.Hidden != nil {
+			fmt.Fprintf(w, "Hidden:\t%t\n", *res.Hidden)
+		}
+		if res.ReadOnly != nil {
+			fmt.Fprintf(w, "ReadOnly:\t%t\n", *res.ReadOnly)
+		}
+		return w.Flush()
+	},
+}
+
+func newStatResult(path string, info *types.GuestFileInfo) statResult {
+	res := statResult{
+		Path: path,
+		Type: info.Type,
+		Size: info.Size,
+	}
+	if info.Attributes == nil {
+		return res
+	}
+
+	common := info.Attributes.GetGuestFileAttributes()
+	res.SymlinkTarget = common.SymlinkTarget
+	res.Modified = common.ModificationTime
+	res.Accessed = common.AccessTime
+
+	switch attr := info.Attributes.(type) {
+	case *types.GuestPosixFileAttributes:
+		res.Owner = attr.OwnerId
+		res.Group = attr.GroupId
+		res.Mode = formatPosixMode(info.Type, attr.Permissions)
+	case *types.GuestWindowsFileAttributes:
+		res.Created = attr.CreateTime
+		res.Hidden = attr.Hidden
+		res.ReadOnly = attr.ReadOnly
+	}
+	return res
+}
+
+// formatPosixMode renders stat(2) permissions like "0755 (drwxr-xr-x)"
+func formatPosixMode(fileType string, permissions int64) string {
+	perm := os.FileMode(permissions & 0o777)
+	switch fileType {
+	case string(types.GuestFileTypeDirectory):
+		perm |= os.ModeDir
+	case string(types.GuestFileTypeSymlink):
+		perm |= os.ModeSymlink
+	}
+	return fmt.Sprintf("%04o (%s)", permissions&0o7777, perm)
+}
+
+func init() {
+	rootCmd.AddCommand(statCmd)
+	statCmd.Flags().StringVar(&statGuestUser, "guest-user", "", "Guest OS Username")
+	statCmd.Flags().StringVar(&statGuestPwd, "guest-password", "", "Guest OS Password")
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	sumGuestUser string
+	sumGuestPwd  string
+)
+
+type sumResult struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+var sumCmd = &cobra.Command{
+	Use:   "sum <remote-path>...",
+	Short: "Print the SHA-256 checksum of guest files",
+	Long: `Computes SHA-256 checksums in the guest (sha256sum on Linux, Get-FileHash on
+Windows) without downloading the files. Output matches sha256sum.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&sumGuestUser, &sumGuestPwd); err != nil {
+			return err
+		}
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, sumGuestUser, sumGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		var results []sumResult
+		var errs []error
+		for _, path := range args {
+			hash, err := guestSum(ctx, g, path)
+			if err != nil {
+				errs = append(errs, err)
+				results = append(results, sumResult{Path: path, Error: err.Error()})
+				continue
+			}
+			results = append(results, sumResult{Path: path, SHA256: hash})
+			if !jsonOutput() {
+				fmt.Printf("%s  %s\n", hash, path)
+			}
+		}
+
+		if jsonOutput() {
+			if err := printJSON(results); err != nil {
+				return err
+			}
+		}
+		return errors.Join(errs...)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sumCmd)
+	sumCmd.Flags().StringVar(&sumGuestUser, "guest-user", "", "Guest OS Username")
+	sumCmd.Flags().StringVar(&sumGuestPwd, "guest-password", "", "Guest OS Password")
+}
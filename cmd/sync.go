@@ -0,0 +1,413 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	syncGuestUser string
+	syncGuestPwd  string
+	syncDownload  bool
+	syncDelete    bool
+	syncDryRun    bool
+	syncChecksum  bool
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <local-dir> <remote-dir>",
+	Short: "Copy only changed files between a local and a guest directory",
+	Long: `Synchronises a local directory tree into a guest directory, or with
+--download the guest tree into the local directory. Files are transferred when
+their size or modification time differ, or with --checksum when their SHA-256
+(computed in the guest in one pass) differs. Transferred files keep their
+modification time so unchanged files are skipped next time.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&syncGuestUser, &syncGuestPwd); err != nil {
+			return err
+		}
+		localRoot, remoteRoot := args[0], args[1]
+
+		if info, err := os.Stat(localRoot); err == nil && !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", localRoot)
+		} else if err != nil && !(syncDownload && errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, syncGuestUser, syncGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		s := &guestSync{g: g, localRoot: localRoot, remoteRoot: remoteRoot}
+		if s.local, err = localTree(localRoot); err != nil {
+			return err
+		}
+		if s.remote, err = remoteTree(ctx, g, remoteRoot, !syncDownload); err != nil {
+			return err
+		}
+
+		src, dst := s.local, s.remote
+		if syncDownload {
+			src, dst = s.remote, s.local
+		}
+
+		var plan syncPlan
+		if err := s.plan(ctx, src, dst, &plan); err != nil {
+			return err
+		}
+		if !syncDryRun {
+			s.apply(ctx, &plan)
+		}
+		return s.report(&plan)
+	},
+}
+
+// syncEntry describes a file or directory on either side of a sync
+type syncEntry struct {
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+	Mode    uint32
+}
+
+type syncAction struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Error  string `json:"error,omitempty"`
+}
+
+type syncPlan struct {
+	Actions   []syncAction `json:"actions"`
+	Unchanged int          `json:"unchanged"`
+	DryRun    bool         `json:"dry_run"`
+}
+
+type guestSync struct {
+	g                     *vsphere.Guest
+	localRoot, remoteRoot string
+	local, remote         map[string]syncEntry
+}
+
+func localTree(root string) (map[string]syncEntry, error) {
+	tree := map[string]syncEntry{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == root {
+			return filepath.SkipAll
+		}
+		if err != nil || path == root {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// Only regular files and directories are synced
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		tree[filepath.ToSlash(rel)] = syncEntry{Dir: info.IsDir(), Size: info.Size(), ModTime: info.ModTime(), Mode: uint32(info.Mode().Perm())}
+		return nil
+	})
+	return tree, err
+}
+
+// remoteTree lists the guest tree under root. A missing root is an empty tree
+// when missingOK is set, i.e. when the guest is the destination; any other
+// listing failure is an error, so --delete never acts on a partial tree.
+func remoteTree(ctx context.Context, g *vsphere.Guest, root string, missingOK bool) (map[string]syncEntry, error) {
+	tree := map[string]syncEntry{}
+	rootListed := false
+	err := g.Walk(ctx, root, func(rel string, f types.GuestFileInfo) error {
+		rootListed = true
+		if f.Type == string(types.GuestFileTypeSymlink) {
+			return nil
+		}
+		e := syncEntry{Dir: f.Type == string(types.GuestFileTypeDirectory), Size: f.Size}
+		if a := f.Attributes.GetGuestFileAttributes(); a.ModificationTime != nil {
+			e.ModTime = *a.ModificationTime
+		}
+		if posix, ok := f.Attributes.(*types.GuestPosixFileAttributes); ok {
+			e.Mode = uint32(posix.Permissions) & 0o777
+		}
+		tree[rel] = e
+		return nil
+	})
+	// A missing destination directory is created by the sync
+	if missingOK && !rootListed && errors.Is(err, vsphere.ErrNotFound) {
+		return tree, nil
+	}
+	return tree, err
+}
+
+// plan compares the trees and lists the directories to create, files to copy
+// and, with --delete, the destination entries to remove
+func (s *guestSync) plan(ctx context.Context, src, dst map[string]syncEntry, plan *syncPlan) error {
+	var sums map[string]string
+	if syncChecksum {
+		var err error
+		if sums, err = s.remoteSums(ctx); err != nil {
+			return err
+		}
+	}
+
+	copyAction, mkdirAction := "upload", "mkdir-remote"
+	if syncDownload {
+		copyAction, mkdirAction = "download", "mkdir-local"
+	}
+
+	// Sorted, so parents come before their contents
+	for _, rel := range sortedKeys(src) {
+		se := src[rel]
+		de, exists := dst[rel]
+		switch {
+		case exists && se.Dir != de.Dir:
+			plan.Actions = append(plan.Actions, syncAction{Action: "skip", Path: rel, Error: "file and directory conflict"})
+		case se.Dir:
+			if !exists {
+				plan.Actions = append(plan.Actions, syncAction{Action: mkdirAction, Path: rel})
+			}
+		case !exists || s.differs(rel, se, de, sums):
+			plan.Actions = append(plan.Actions, syncAction{Action: copyAction, Path: rel})
+		default:
+			plan.Unchanged++
+		}
+	}
+
+	if syncDelete {
+		var deleted []string
+		for _, rel := range sortedKeys(dst) {
+			if _, ok := src[rel]; ok || underAny(rel, deleted) {
+				continue
+			}
+			deleted = append(deleted, rel)
+			action := "delete-remote"
+			if syncDownload {
+				action = "delete-local"
+			}
+			plan.Actions = append(plan.Actions, syncAction{Action: action, Path: rel})
+		}
+	}
+	plan.DryRun = syncDryRun
+	return nil
+}
+
+func (s *guestSync) differs(rel string, se, de syncEntry, sums map[string]string) bool {
+	if se.Size != de.Size {
+		return true
+	}
+	if sums == nil {
+		// The guest reports whole seconds
+		return se.ModTime.Unix() != de.ModTime.Unix()
+	}
+	local, err := localSum(filepath.Join(s.localRoot, filepath.FromSlash(rel)))
+	return err != nil || local != sums[rel]
+}
+
+// remoteSums checksums the remote tree, which must exist
+func (s *guestSync) remoteSums(ctx context.Context) (map[string]string, error) {
+	if len(s.remote) == 0 {
+		return map[string]string{}, nil
+	}
+	dir, err := createGuestWorkspace(ctx, s.g)
+	if err != nil {
+		return nil, err
+	}
+	defer removeGuestWorkspace(ctx, s.g, dir)
+	return guestTreeSums(ctx, s.g, dir, s.remoteRoot)
+}
+
+// apply carries out the plan, recording failures on each action
+func (s *guestSync) apply(ctx context.Context, plan *syncPlan) {
+	// Create the destination root itself
+	if len(plan.Actions) > 0 {
+		action := &syncAction{Action: "mkdir-remote", Path: "."}
+		if syncDownload {
+			action.Action = "mkdir-local"
+		}
+		if err := s.do(ctx, action); err != nil {
+			action.Error = err.Error()
+			plan.Actions = []syncAction{*action}
+			return
+		}
+	}
+
+	for i := range plan.Actions {
+		a := &plan.Actions[i]
+		if a.Error != "" {
+			continue
+		}
+		if err := s.do(ctx, a); err != nil {
+			a.Error = err.Error()
+		}
+	}
+}
+
+func (s *guestSync) do(ctx context.Context, a *syncAction) error {
+	localPath := filepath.Join(s.localRoot, filepath.FromSlash(a.Path))
+	remotePath := s.remotePath(a.Path)
+
+	switch a.Action {
+	case "mkdir-remote":
+		err := s.g.Files.MakeDirectory(ctx, s.g.Auth, remotePath, true)
+		if err := vsphere.FileError("mkdir", remotePath, err); err != nil && !errors.Is(err, vsphere.ErrExists) {
+			return err
+		}
+	case "mkdir-local":
+		return os.MkdirAll(localPath, 0o755)
+	case "upload":
+		return s.upload(ctx, localPath, remotePath, s.local[a.Path])
+	case "download":
+		return s.download(ctx, remotePath, localPath, s.remote[a.Path])
+	case "delete-remote":
+		var err error
+		if s.remote[a.Path].Dir {
+			err = s.g.Files.DeleteDirectory(ctx, s.g.Auth, remotePath, true)
+		} else {
+			err = s.g.Files.DeleteFile(ctx, s.g.Auth, remotePath)
+		}
+		return vsphere.FileError("delete", remotePath, err)
+	case "delete-local":
+		return os.RemoveAll(localPath)
+	}
+	return nil
+}
+
+func (s *guestSync) upload(ctx context.Context, localPath, remotePath string, e syncEntry) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Carry the mtime over so the file compares equal next time
+	mtime := e.ModTime
+	var attr types.BaseGuestFileAttributes
+	if s.g.IsWindows() {
+		attr = &types.GuestWindowsFileAttributes{GuestFileAttributes: types.GuestFileAttributes{ModificationTime: &mtime}}
+	} else {
+		attr = &types.GuestPosixFileAttributes{Permissions: int64(e.Mode), GuestFileAttributes: types.GuestFileAttributes{ModificationTime: &mtime}}
+	}
+	p := newProgress(localPath, e.Size, false)
+	defer p.Finish()
+	return vsphere.FileError("upload", remotePath, s.g.Upload(ctx, remotePath, p.Reader(f), e.Size, attr, true))
+}
+
+func (s *guestSync) download(ctx context.Context, remotePath, localPath string, e syncEntry) error {
+	body, transfer, err := s.g.Download(ctx, remotePath)
+	if err != nil {
+		return vsphere.FileError("download", remotePath, err)
+	}
+	defer body.Close()
+
+	mode := os.FileMode(0o644)
+	if e.Mode != 0 {
+		mode = os.FileMode(e.Mode)
+	}
+	out, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	p := newProgress(remotePath, transfer.Size, false)
+	_, err = io.Copy(out, p.Reader(body))
+	p.Finish()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, e.ModTime, e.ModTime)
+}
+
+func (s *guestSync) remotePath(rel string) string {
+	if rel == "." {
+		return s.remoteRoot
+	}
+	if s.g.IsWindows() {
+		rel = strings.ReplaceAll(rel, "/", "\\")
+	}
+	return guestJoin(s.g, s.remoteRoot, rel)
+}
+
+func (s *guestSync) report(plan *syncPlan) error {
+	var failed int
+	for _, a := range plan.Actions {
+		if a.Error != "" {
+			failed++
+		}
+	}
+
+	if jsonOutput() {
+		if err := printJSON(plan); err != nil {
+			return err
+		}
+	} else {
+		for _, a := range plan.Actions {
+			if a.Error != "" {
+				fmt.Printf("%-14s %s: %s\n", a.Action, a.Path, a.Error)
+			} else {
+				fmt.Printf("%-14s %s\n", a.Action, a.Path)
+			}
+		}
+		suffix := ""
+		if plan.DryRun {
+			suffix = " (dry run)"
+		}
+		fmt.Printf("%d changes, %d unchanged, %d failed%s\n", len(plan.Actions)-failed, plan.Unchanged, failed, suffix)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d changes failed", failed, len(plan.Actions))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]syncEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// underAny reports whether rel lies inside one of dirs
+func underAny(rel string, dirs []string) bool {
+	for _, d := range dirs {
+		if strings.HasPrefix(rel, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().StringVar(&syncGuestUser, "guest-user", "", "Guest OS Username")
+	syncCmd.Flags().StringVar(&syncGuestPwd, "guest-password", "", "Guest OS Password")
+	syncCmd.Flags().BoolVar(&syncDownload, "download", false, "Sync the guest directory into the local directory instead")
+	syncCmd.Flags().BoolVar(&syncDelete, "delete", false, "Delete destination files that do not exist in the source")
+	syncCmd.Flags().BoolVarP(&syncDryRun, "dry-run", "n", false, "Show what would change without changing anything")
+	syncCmd.Flags().BoolVarP(&syncChecksum, "checksum", "c", false, "Compare SHA-256 checksums instead of modification times")
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"vsphere-guest-cli/pkg/vsphere"
+)
+
+var (
+	writeGuestUser string
+	writeGuestPwd  string
+	writeAppend    bool
+	writeNoClobber bool
+)
+
+var writeCmd = &cobra.Command{
+	Use:     "write <remote-path>",
+	Aliases: []string{"tee"},
+	Short:   "Write stdin to a file in the guest VM",
+	Long: `Reads stdin to the end and writes it to a guest file. Invoked as "tee", the
+input is also copied to stdout.
+
+--append downloads the current content and uploads it again with the input
+added, so concurrent writers in the guest may be overwritten.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireGuestArgs(&writeGuestUser, &writeGuestPwd); err != nil {
+			return err
+		}
+		if writeAppend && writeNoClobber {
+			return fmt.Errorf("--append and --no-clobber cannot be used together")
+		}
+		remotePath := args[0]
+
+		ctx := cmd.Context()
+		c, g, err := openGuest(ctx, writeGuestUser, writeGuestPwd)
+		if err != nil {
+			return err
+		}
+		defer c.Logout(ctx)
+
+		var input io.Reader = os.Stdin
+		if cmd.CalledAs() == "tee" {
+			input = io.TeeReader(os.Stdin, os.Stdout)
+		}
+
+		readers := []io.Reader{input}
+		if writeAppend {
+			body, _, err := g.Download(ctx, remotePath)
+			err = vsphere.FileError("write", remotePath, err)
+			switch {
+			case err == nil:
+				defer body.Close()
+				readers = []io.Reader{body, input}
+			case !errors.Is(err, vsphere.ErrNotFound):
+				return err
+			}
+		}
+
+		// The upload needs its size up front, so collect the input first
+		spool, size, err := spoolLocal(readers...)
+		if err != nil {
+			return err
+		}
+		defer removeSpool(spool)
+
+		p := newProgress(remotePath, size, cmd.CalledAs() == "tee")
+		err = g.Upload(ctx, remotePath, p.Reader(spool), size, nil, !writeNoClobber)
+		p.Finish()
+		if err := vsphere.FileError("write", remotePath, err); err != nil {
+			return err
+		}
+
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s\n", size, remotePath)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(writeCmd)
+	writeCmd.Flags().StringVar(&writeGuestUser, "guest-user", "", "Guest OS Username")
+	writeCmd.Flags().StringVar(&writeGuestPwd, "guest-password", "", "Guest OS Password")
+	writeCmd.Flags().BoolVarP(&writeAppend, "append", "a", false, "Append to the file instead of replacing it")
+	writeCmd.Flags().BoolVarP(&writeNoClobber, "no-clobber", "n", false, "Fail if the file already exists")
+}
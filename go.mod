@@ -5,6 +5,7 @@ go 1.23.0
 require (
 	github.com/spf13/cobra v1.10.1
 	github.com/vmware/govmomi v0.52.0
+	golang.org/x/text v0.28.0
 )
 
 require (
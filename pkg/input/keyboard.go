@@ -48,7 +48,7 @@ func StringToUsbScanCodes(s string) ([]types.UsbScanCodeSpecKeyEvent, error) {
 	for _, char := range s {
 		def, ok := keyMap[char]
 		if !ok {
-			fmt.Printf("Warning: Skipping unsupported character '%%c'\n", char)
+			fmt.Printf("Warning: Skipping unsupported character '%c'\n", char)
 			continue
 		}
 
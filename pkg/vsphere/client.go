@@ -5,16 +5,19 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session/keepalive"
 	"github.com/vmware/govmomi/vim25/soap"
 )
 
 type Client struct {
-	Client *govmomi.Client
-	Finder *find.Finder
+	Client   *govmomi.Client
+	Finder   *find.Finder
+	Insecure bool
 }
 
 // ConnectionConfig holds the parameters for connecting to vSphere
@@ -54,8 +57,9 @@ func NewClient(ctx context.Context, config ConnectionConfig) (*Client, error) {
 	}
 
 	return &Client{
-		Client: c,
-		Finder: finder,
+		Client:   c,
+		Finder:   finder,
+		Insecure: insecure,
 	}, nil
 }
 
@@ -84,6 +88,15 @@ func (c *Client) FindVM(ctx context.Context, name string) (*object.VirtualMachin
 	return vm, err
 }
 
+// KeepAlive pings vSphere every idle interval so long-lived sessions do not time out.
+// It stops on Logout.
+func (c *Client) KeepAlive(idle time.Duration) {
+	h := keepalive.NewHandlerSOAP(c.Client.Client.RoundTripper, idle, nil)
+	c.Client.Client.RoundTripper = h
+	// The handler normally starts on Login, which has already happened
+	h.Start()
+}
+
 // Logout logs out of the vSphere session
 func (c *Client) Logout(ctx context.Context) {
 	if c.Client != nil {
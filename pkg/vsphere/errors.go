@@ -0,0 +1,55 @@
+package vsphere
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vmware/govmomi/fault"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+var (
+	// ErrNotFound is returned when a guest path does not exist
+	ErrNotFound = errors.New("no such file or directory")
+	// ErrPermission is returned when the guest user may not access a path
+	ErrPermission = errors.New("permission denied")
+	// ErrExists is returned when a guest path already exists
+	ErrExists = errors.New("file exists")
+)
+
+// FileError describes a failed guest file operation on path. Common guest
+// faults are translated into short messages; missing paths wrap ErrNotFound,
+// permission faults wrap ErrPermission and existing targets wrap ErrExists.
+func FileError(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var reason error
+	fault.In(err, func(f types.BaseMethodFault, _ string, _ []types.LocalizableMessage) bool {
+		switch f.(type) {
+		case *types.FileNotFound:
+			reason = ErrNotFound
+		case *types.GuestPermissionDenied, *types.NoPermission:
+			reason = ErrPermission
+		case *types.FileAlreadyExists:
+			reason = ErrExists
+		case *types.NotADirectory:
+			reason = errors.New("not a directory")
+		case *types.NotAFile:
+			reason = errors.New("is a directory")
+		case *types.DirectoryNotEmpty:
+			reason = errors.New("directory not empty")
+		case *types.FileLocked:
+			reason = errors.New("file is locked")
+		case *types.InvalidGuestLogin:
+			reason = errors.New("invalid guest credentials")
+		}
+		return reason != nil
+	})
+
+	if reason == nil {
+		reason = err
+	}
+	return fmt.Errorf("%s %s: %w", op, path, reason)
+}
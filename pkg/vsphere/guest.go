@@ -0,0 +1,217 @@
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/vmware/govmomi/guest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Guest bundles the guest operations managers and credentials for a single VM
+type Guest struct {
+	VM        *object.VirtualMachine
+	Auth      *types.NamePasswordAuthentication
+	Processes *guest.ProcessManager
+	Files     *guest.FileManager
+	Family    string
+
+	httpClient *http.Client
+}
+
+// NewGuest prepares guest operations on vm using the given guest OS credentials
+func (c *Client) NewGuest(ctx context.Context, vm *object.VirtualMachine, username, password string) (*Guest, error) {
+	ops := guest.NewOperationsManager(c.Client.Client, vm.Reference())
+
+	procManager, err := ops.ProcessManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fileManager, err := ops.FileManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: c.Insecure},
+	}
+
+	return &Guest{
+		VM: vm,
+		Auth: &types.NamePasswordAuthentication{
+			Username: username,
+			Password: password,
+		},
+		Processes:  procManager,
+		Files:      fileManager,
+		httpClient: &http.Client{Transport: tr},
+	}, nil
+}
+
+// LoadFamily fetches the guest OS family reported by VMware Tools
+func (g *Guest) LoadFamily(ctx context.Context) error {
+	var moVM mo.VirtualMachine
+	if err := g.VM.Properties(ctx, g.VM.Reference(), []string{"guest.guestFamily"}, &moVM); err != nil {
+		return err
+	}
+	if moVM.Guest != nil {
+		g.Family = moVM.Guest.GuestFamily
+	}
+	return nil
+}
+
+// IsWindows reports whether the guest runs Windows
+func (g *Guest) IsWindows() bool {
+	return strings.Contains(strings.ToLower(g.Family), "windows")
+}
+
+// Upload streams size bytes from r to remotePath in the guest
+func (g *Guest) Upload(ctx context.Context, remotePath string, r io.Reader, size int64, attr types.BaseGuestFileAttributes, overwrite bool) error {
+	if attr == nil {
+		attr = &types.GuestFileAttributes{}
+	}
+
+	urlStr, err := g.Files.InitiateFileTransferToGuest(ctx, g.Auth, remotePath, attr, size, overwrite)
+	if err != nil {
+		return fmt.Errorf("failed to initiate upload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", urlStr, r)
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.ContentLength = size
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("upload failed with status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Download opens remotePath in the guest for reading. The caller must close the returned body.
+func (g *Guest) Download(ctx context.Context, remotePath string) (io.ReadCloser, *types.FileTransferInformation, error) {
+	transfer, err := g.Files.InitiateFileTransferFromGuest(ctx, g.Auth, remotePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initiate download: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", transfer.Url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create download request: %w", err)
+	}
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("download failed: %w", err)
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("download failed with status: %s", resp.Status)
+	}
+	return resp.Body, transfer, nil
+}
+
+// ListFiles returns the entries of dir whose names match the Perl-compatible
+// regular expression pattern, following the API's paging until all are fetched
+func (g *Guest) ListFiles(ctx context.Context, dir, pattern string) ([]types.GuestFileInfo, error) {
+	var files []types.GuestFileInfo
+	for {
+		res, err := g.Files.ListFiles(ctx, g.Auth, dir, int32(len(files)), 0, pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, res.Files...)
+		if res.Remaining == 0 || len(res.Files) == 0 {
+			return files, nil
+		}
+	}
+}
+
+// Walk lists the tree under root, calling fn for every entry with its path
+// relative to root, using "/" as the separator. Directories are visited before
+// their contents; symlinks are reported but not followed.
+func (g *Guest) Walk(ctx context.Context, root string, fn func(rel string, info types.GuestFileInfo) error) error {
+	sep := "/"
+	if g.IsWindows() {
+		sep = "\\"
+	}
+
+	var walk func(dir, prefix string) error
+	walk = func(dir, prefix string) error {
+		files, err := g.ListFiles(ctx, dir, "")
+		if err != nil {
+			return FileError("list", dir, err)
+		}
+		for _, f := range files {
+			if f.Path == "." || f.Path == ".." {
+				continue
+			}
+			rel := prefix + f.Path
+			if err := fn(rel, f); err != nil {
+				return err
+			}
+			if f.Type == string(types.GuestFileTypeDirectory) {
+				if err := walk(strings.TrimRight(dir, sep)+sep+f.Path, rel+"/"); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(root, "")
+}
+
+// SplitPath splits a guest path into its parent directory and base name,
+// accepting both separators since Windows guests do
+func SplitPath(p string) (dir, base string) {
+	trimmed := strings.TrimRight(p, "/\\")
+	i := strings.LastIndexAny(trimmed, "/\\")
+	if i < 0 {
+		return "", trimmed
+	}
+	dir = trimmed[:i+1]
+	// Keep the separator for roots like "/" and "C:\"
+	if len(dir) > 1 && !strings.HasSuffix(dir, ":\\") && !strings.HasSuffix(dir, ":/") {
+		dir = dir[:len(dir)-1]
+	}
+	return dir, trimmed[i+1:]
+}
+
+// Stat looks up a single guest path by listing its parent directory with an exact match
+func (g *Guest) Stat(ctx context.Context, p string) (*types.GuestFileInfo, error) {
+	dir, base := SplitPath(p)
+	if base == "" || dir == "" {
+		return nil, fmt.Errorf("%s: path must be absolute and not a root directory", p)
+	}
+
+	// Windows file names are case-insensitive, so the match must be too
+	re := "^" + regexp.QuoteMeta(base) + "$"
+	if g.IsWindows() {
+		re = "(?i)" + re
+	}
+	files, err := g.ListFiles(ctx, dir, re)
+	if err != nil {
+		return nil, FileError("stat", p, err)
+	}
+	for i := range files {
+		if files[i].Path == base || (g.IsWindows() && strings.EqualFold(files[i].Path, base)) {
+			return &files[i], nil
+		}
+	}
+	return nil, fmt.Errorf("stat %s: %w", p, ErrNotFound)
+}
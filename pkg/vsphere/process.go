@@ -0,0 +1,89 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	pollMin = 50 * time.Millisecond
+	pollMax = 2 * time.Second
+
+	// maxPollErrors is how many ListProcesses calls in a row may fail before
+	// WaitProcesses gives up
+	maxPollErrors = 10
+)
+
+// Backoff produces polling delays that start at Min and double up to Max
+type Backoff struct {
+	Min, Max time.Duration
+	next     time.Duration
+}
+
+// Next returns the delay to wait before the next poll
+func (b *Backoff) Next() time.Duration {
+	if b.next == 0 {
+		b.next = b.Min
+	}
+	d := b.next
+	b.next *= 2
+	if b.next > b.Max {
+		b.next = b.Max
+	}
+	return d
+}
+
+// WaitProcesses polls until every pid has exited. All pids are checked with a
+// single ListProcesses call per poll, and polling backs off from 50ms to 2s so
+// short commands return quickly while long ones make few API calls.
+// Processes that finished are returned with their info; pids that vanished from
+// the process table without an end time map to nil. Failed polls are retried,
+// but an error is returned once maxPollErrors fail in a row.
+func (g *Guest) WaitProcesses(ctx context.Context, pids []int64) (map[int64]*types.GuestProcessInfo, error) {
+	done := make(map[int64]*types.GuestProcessInfo, len(pids))
+	pending := append([]int64(nil), pids...)
+	backoff := Backoff{Min: pollMin, Max: pollMax}
+	failures := 0
+
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return done, ctx.Err()
+		case <-time.After(backoff.Next()):
+		}
+
+		procs, err := g.Processes.ListProcesses(ctx, g.Auth, pending)
+		if err != nil {
+			// Transient tools hiccups are common on busy guests; keep polling
+			// unless the guest stays unreachable
+			if failures++; failures >= maxPollErrors {
+				return done, fmt.Errorf("failed to list guest processes %d times in a row: %w", failures, err)
+			}
+			continue
+		}
+		failures = 0
+
+		listed := make(map[int64]*types.GuestProcessInfo, len(procs))
+		for i := range procs {
+			listed[procs[i].Pid] = &procs[i]
+		}
+
+		var still []int64
+		for _, pid := range pending {
+			info, ok := listed[pid]
+			switch {
+			case !ok:
+				done[pid] = nil
+			case info.EndTime != nil:
+				done[pid] = info
+			default:
+				still = append(still, pid)
+			}
+		}
+		pending = still
+	}
+	return done, nil
+}